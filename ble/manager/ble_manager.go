@@ -19,6 +19,8 @@ type BluetoothWiFiProvisioner interface {
 	Stop(context.Context) error
 	Update(context.Context, *bp.AvailableWiFiNetworks) error
 	WaitForCredentials(context.Context) (*credentials, error)
+	ReportStatus(context.Context, *bp.ProvisioningStatus) error
+	HandleCommand(bp.Command, bp.CommandHandler)
 }
 
 // BluetoothManager provides an interface for managing a BLE (bluetooth-low-energy) peripheral advertisement on Linux.
@@ -41,12 +43,49 @@ func (bm *bluetoothWiFiProvisioner) Update(ctx context.Context, awns *bp.Availab
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
-	bm.blep.UpdateAvailableWiFiNetworks(awns)
-	return nil
+	return bm.blep.UpdateAvailableWiFiNetworks(awns)
 }
 
 // WaitForCredentials returns credentials which represent the information required to provision a robot part and its WiFi.
+// It returns bp.ErrAdvertisingTimeout if the advertising window elapses first.
 func (bm *bluetoothWiFiProvisioner) WaitForCredentials(ctx context.Context) (*credentials, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if timeout := bm.blep.AdvertisingTimeout(); timeout != nil {
+		utils.ManagedGo(func() {
+			select {
+			case <-timeout:
+				cancel(bp.ErrAdvertisingTimeout)
+			case <-ctx.Done():
+			}
+		}, nil)
+	}
+
+	for {
+		creds, err := waitForCredentialValues(ctx, bm.blep)
+		if cause := context.Cause(ctx); errors.Is(cause, bp.ErrAdvertisingTimeout) {
+			return nil, cause
+		}
+		if err != nil {
+			return creds, err
+		}
+
+		// The session may have been reset (see bp.CommandResetSession) while waiting for the remaining values, in which
+		// case every value has to be written again.
+		creds, err = readCredentialValues(bm.blep)
+		var errBLECharNoValue *bp.ErrBLECharNoValue
+		if errors.As(err, &errBLECharNoValue) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return creds, bm.blep.UpdateStatus(&bp.ProvisioningStatus{State: bp.StateCredentialsReceived})
+	}
+}
+
+// waitForCredentialValues waits until a value has been written to each credential characteristic.
+func waitForCredentialValues(ctx context.Context, blep bp.BLEPeripheral) (*credentials, error) {
 	var ssid, psk, robotPartKeyID, robotPartKey string
 	var ssidErr, pskErr, robotPartKeyIDErr, robotPartKeyErr error
 
@@ -54,42 +93,79 @@ func (bm *bluetoothWiFiProvisioner) WaitForCredentials(ctx context.Context) (*cr
 	wg.Add(4)
 	utils.ManagedGo(
 		func() {
-			ssid, ssidErr = waitForBLEValue(ctx, bm.blep.ReadSsid, "ssid")
+			ssid, ssidErr = waitForBLEValue(ctx, blep, bp.SsidCharacteristic)
 		},
 		wg.Done,
 	)
 	utils.ManagedGo(
 		func() {
-			psk, pskErr = waitForBLEValue(ctx, bm.blep.ReadPsk, "psk")
+			psk, pskErr = waitForBLEValue(ctx, blep, bp.PskCharacteristic)
 		},
 		wg.Done,
 	)
 	utils.ManagedGo(
 		func() {
-			robotPartKeyID, robotPartKeyIDErr = waitForBLEValue(ctx, bm.blep.ReadRobotPartKeyID, "robot part key ID")
+			robotPartKeyID, robotPartKeyIDErr = waitForBLEValue(ctx, blep, bp.RobotPartKeyIDCharacteristic)
 		},
 		wg.Done,
 	)
 	utils.ManagedGo(
 		func() {
-			robotPartKey, robotPartKeyErr = waitForBLEValue(ctx, bm.blep.ReadRobotPartKey, "robot part key")
+			robotPartKey, robotPartKeyErr = waitForBLEValue(ctx, blep, bp.RobotPartKeyCharacteristic)
 		},
 		wg.Done,
 	)
 	wg.Wait()
 
+	creds := &credentials{
+		ssid: ssid, psk: psk, robotPartKeyID: robotPartKeyID, robotPartKey: robotPartKey,
+	}
+	return creds, multierr.Combine(ssidErr, pskErr, robotPartKeyIDErr, robotPartKeyErr)
+}
+
+// readCredentialValues reads the current value of each credential characteristic.
+func readCredentialValues(blep bp.BLEPeripheral) (*credentials, error) {
+	ssid, ssidErr := bp.Read[string](blep, bp.SsidCharacteristic)
+	psk, pskErr := bp.Read[string](blep, bp.PskCharacteristic)
+	robotPartKeyID, robotPartKeyIDErr := bp.Read[string](blep, bp.RobotPartKeyIDCharacteristic)
+	robotPartKey, robotPartKeyErr := bp.Read[string](blep, bp.RobotPartKeyCharacteristic)
+	if err := multierr.Combine(ssidErr, pskErr, robotPartKeyIDErr, robotPartKeyErr); err != nil {
+		return nil, err
+	}
 	return &credentials{
 		ssid: ssid, psk: psk, robotPartKeyID: robotPartKeyID, robotPartKey: robotPartKey,
-	}, multierr.Combine(ssidErr, pskErr, robotPartKeyIDErr, robotPartKeyErr)
+	}, nil
+}
+
+// ReportStatus reports the progress of provisioning (e.g. connecting to WiFi) to bluetooth clients.
+func (bm *bluetoothWiFiProvisioner) ReportStatus(ctx context.Context, status *bp.ProvisioningStatus) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return bm.blep.UpdateStatus(status)
+}
+
+// HandleCommand registers the handler for a command written by bluetooth clients, replacing any registered before.
+// Commands without a handler are rejected, except for bp.CommandResetSession, which the peripheral carries out itself.
+func (bm *bluetoothWiFiProvisioner) HandleCommand(command bp.Command, handler bp.CommandHandler) {
+	bm.blep.HandleCommand(command, handler)
 }
 
 // NewBluetoothWiFiProvisioner returns a service which accepts credentials over bluetooth to provision a robot and its WiFi connection.
-func NewBluetoothWiFiProvisioner(ctx context.Context, logger golog.Logger, name string) (BluetoothWiFiProvisioner, error) {
-	blep, err := bp.NewLinuxBLEPeripheral(ctx, logger, name)
+func NewBluetoothWiFiProvisioner(
+	ctx context.Context, logger golog.Logger, name string, opts ...bp.Option,
+) (BluetoothWiFiProvisioner, error) {
+	blep, err := bp.NewLinuxBLEPeripheral(ctx, logger, name, opts...)
 	if err != nil {
 		return nil, errors.WithMessage(err, "failed to set up bluetooth-low-energy peripheral (Linux)")
 	}
-	return &bluetoothWiFiProvisioner{blep: blep}, nil
+	return NewBluetoothWiFiProvisionerWithPeripheral(blep), nil
+}
+
+// NewBluetoothWiFiProvisionerWithPeripheral returns a service which accepts credentials over the given BLE peripheral,
+// e.g. an in-memory peripheral for tests and simulation.
+func NewBluetoothWiFiProvisionerWithPeripheral(blep bp.BLEPeripheral) BluetoothWiFiProvisioner {
+	return &bluetoothWiFiProvisioner{blep: blep}
 }
 
 // credentials represents the minimum required information needed to provision a Viam Agent.
@@ -122,7 +198,7 @@ func (c *credentials) GetRobotPartKey() string {
 
 // waitForBLE is used to check for the existence of a new value in a BLE characteristic.
 func waitForBLEValue(
-	ctx context.Context, fn func() (string, error), description string,
+	ctx context.Context, blep bp.BLEPeripheral, name string,
 ) (string, error) {
 	for {
 		if ctx.Err() != nil {
@@ -134,13 +210,13 @@ func waitForBLEValue(
 		default:
 			time.Sleep(time.Second)
 		}
-		v, err := fn()
+		v, err := bp.Read[string](blep, name)
 		if err != nil {
 			var errBLECharNoValue *bp.ErrBLECharNoValue
 			if errors.As(err, &errBLECharNoValue) {
 				continue
 			}
-			return "", errors.WithMessagef(err, "failed to read %s", description)
+			return "", errors.WithMessagef(err, "failed to read %s", name)
 		}
 		return v, nil
 	}
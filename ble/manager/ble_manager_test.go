@@ -0,0 +1,261 @@
+package blemanager
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/edaniels/golog"
+
+	bp "github.com/maxhorowitz/btprov/ble/peripheral"
+)
+
+const testCentral = "AC:DE:48:00:11:22"
+
+// testClient plays the part of a provisioning app connected to an in-memory peripheral.
+type testClient struct {
+	t    *testing.T
+	m    *bp.MemoryBLEPeripheral
+	aead cipher.AEAD // Nil unless credentials are encrypted.
+}
+
+func newTestClient(ctx context.Context, t *testing.T, opts ...bp.Option) *testClient {
+	t.Helper()
+	m, err := bp.NewMemoryBLEPeripheral(ctx, golog.NewTestLogger(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.StartAdvertising(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SimulateConnect(testCentral); err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, m: m}
+}
+
+// write writes value in two fragments, as a client does with a long write, and commits it.
+func (c *testClient) write(component uint16, value []byte) {
+	c.t.Helper()
+	half := len(value) / 2
+	if err := c.m.SimulateWrite(testCentral, component, 0, value[:half]); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.m.SimulateWrite(testCentral, component, half, value[half:]); err != nil {
+		c.t.Fatal(err)
+	}
+	c.m.FlushWrites()
+}
+
+func (c *testClient) read(component uint16) []byte {
+	c.t.Helper()
+	value, err := c.m.SimulateRead(testCentral, component)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return value
+}
+
+// writeCredential writes a credential, encrypted if a session key was exchanged.
+func (c *testClient) writeCredential(component uint16, value string) {
+	c.t.Helper()
+	if c.aead == nil {
+		c.write(component, []byte(value))
+		return
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		c.t.Fatal(err)
+	}
+	ad := []byte(bp.DeriveUUID(bp.DefaultBaseUUID, component).String())
+	c.write(component, c.aead.Seal(nonce, nonce, []byte(value), ad))
+}
+
+// prove responds to the proof-of-possession challenge.
+func (c *testClient) prove(secret []byte) {
+	c.t.Helper()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(c.read(bp.PoPChallengeUUIDComponent))
+	c.write(bp.PoPResponseUUIDComponent, mac.Sum(nil))
+}
+
+// exchangeKeys derives the session key as described in the README.
+func (c *testClient) exchangeKeys(secret []byte) {
+	c.t.Helper()
+	devicePublicKey := c.read(bp.DevicePublicKeyUUIDComponent)
+	clientKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.write(bp.ClientPublicKeyUUIDComponent, clientKey.PublicKey().Bytes())
+
+	peer, err := ecdh.X25519().NewPublicKey(devicePublicKey)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sharedSecret, err := clientKey.ECDH(peer)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	salt := append(append(append([]byte{}, devicePublicKey...), clientKey.PublicKey().Bytes()...), secret...)
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(sharedSecret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("btprov credentials v1"))
+	expand.Write([]byte{0x01})
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if c.aead, err = cipher.NewGCM(block); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) status() bp.ProvisioningState {
+	c.t.Helper()
+	var status bp.ProvisioningStatus
+	if err := json.Unmarshal(c.read(bp.StatusUUIDComponent), &status); err != nil {
+		c.t.Fatal(err)
+	}
+	return status.State
+}
+
+type waitResult struct {
+	creds *credentials
+	err   error
+}
+
+func waitForCredentials(ctx context.Context, bwp BluetoothWiFiProvisioner) <-chan waitResult {
+	result := make(chan waitResult, 1)
+	go func() {
+		creds, err := bwp.WaitForCredentials(ctx)
+		result <- waitResult{creds, err}
+	}()
+	return result
+}
+
+func checkCredentials(t *testing.T, result waitResult, ssid, psk, robotPartKeyID, robotPartKey string) {
+	t.Helper()
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	creds := result.creds
+	if creds.GetSSID() != ssid || creds.GetPsk() != psk || creds.GetRobotPartKeyID() != robotPartKeyID ||
+		creds.GetRobotPartKey() != robotPartKey {
+		t.Errorf("received credentials %+v, want %q, %q, %q and %q", *creds, ssid, psk, robotPartKeyID, robotPartKey)
+	}
+}
+
+func TestWaitForCredentials(t *testing.T) {
+	secret := []byte("label secret")
+	for _, tc := range []struct {
+		name string
+		opts []bp.Option
+	}{
+		{"plaintext", nil},
+		{"encrypted with proof of possession", []bp.Option{bp.WithEncryptedCredentials(), bp.WithProofOfPossession(secret)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			c := newTestClient(ctx, t, tc.opts...)
+			bwp := NewBluetoothWiFiProvisionerWithPeripheral(c.m)
+			result := waitForCredentials(ctx, bwp)
+
+			if len(tc.opts) > 0 {
+				c.prove(secret)
+				c.exchangeKeys(secret)
+			}
+			c.writeCredential(bp.SsidUUIDComponent, "net")
+			c.writeCredential(bp.PskUUIDComponent, "password1")
+			c.writeCredential(bp.RobotPartKeyIDUUIDComponent, "0b4a5e0e-7d6b-4a3b-9a3e-1f2d3c4b5a69")
+			c.writeCredential(bp.RobotPartKeyUUIDComponent, "secretkey")
+
+			checkCredentials(t, <-result, "net", "password1", "0b4a5e0e-7d6b-4a3b-9a3e-1f2d3c4b5a69", "secretkey")
+			if state := c.status(); state != bp.StateCredentialsReceived {
+				t.Errorf("status is %s, want %s", state, bp.StateCredentialsReceived)
+			}
+		})
+	}
+}
+
+func TestWaitForCredentialsRejectsInvalidValues(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := newTestClient(ctx, t)
+	bwp := NewBluetoothWiFiProvisionerWithPeripheral(c.m)
+	result := waitForCredentials(ctx, bwp)
+
+	c.writeCredential(bp.PskUUIDComponent, "short")
+	var rejection bp.WriteRejection
+	if err := json.Unmarshal(c.read(bp.WriteRejectionUUIDComponent), &rejection); err != nil {
+		t.Fatal(err)
+	}
+	if rejection.Characteristic != bp.PskCharacteristic || rejection.Reason == "" {
+		t.Errorf("write rejection is %+v, want one for %s", rejection, bp.PskCharacteristic)
+	}
+
+	c.writeCredential(bp.SsidUUIDComponent, "net")
+	c.writeCredential(bp.PskUUIDComponent, "password1")
+	c.writeCredential(bp.RobotPartKeyIDUUIDComponent, "0b4a5e0e-7d6b-4a3b-9a3e-1f2d3c4b5a69")
+	c.writeCredential(bp.RobotPartKeyUUIDComponent, "secretkey")
+	checkCredentials(t, <-result, "net", "password1", "0b4a5e0e-7d6b-4a3b-9a3e-1f2d3c4b5a69", "secretkey")
+}
+
+func TestWaitForCredentialsAfterResetSession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := newTestClient(ctx, t)
+	bwp := NewBluetoothWiFiProvisionerWithPeripheral(c.m)
+	result := waitForCredentials(ctx, bwp)
+
+	// Write wrong credentials and give the provisioner time to see them before resetting the session.
+	c.writeCredential(bp.SsidUUIDComponent, "wrong")
+	c.writeCredential(bp.PskUUIDComponent, "wrongpassword")
+	c.writeCredential(bp.RobotPartKeyIDUUIDComponent, "0b4a5e0e-7d6b-4a3b-9a3e-1f2d3c4b5a69")
+	time.Sleep(1500 * time.Millisecond)
+	c.write(bp.CommandUUIDComponent, []byte(bp.CommandResetSession))
+	if _, err := bp.Read[string](c.m, bp.SsidCharacteristic); err == nil {
+		t.Fatal("SSID was not cleared by the session reset")
+	}
+	if state := c.status(); state != bp.StateWaiting {
+		t.Errorf("status is %s after the session reset, want %s", state, bp.StateWaiting)
+	}
+
+	// The last credential completes the wrong set, but the reset ones must be written again.
+	c.writeCredential(bp.RobotPartKeyUUIDComponent, "secretkey")
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case r := <-result:
+		t.Fatalf("received credentials %+v (%v) before every value was written again", r.creds, r.err)
+	default:
+	}
+	c.writeCredential(bp.SsidUUIDComponent, "net")
+	c.writeCredential(bp.PskUUIDComponent, "password1")
+	c.writeCredential(bp.RobotPartKeyIDUUIDComponent, "1c5b6f1f-8e7c-4b4c-8b4f-2e3d4c5b6a7f")
+
+	checkCredentials(t, <-result, "net", "password1", "1c5b6f1f-8e7c-4b4c-8b4f-2e3d4c5b6a7f", "secretkey")
+}
+
+func TestWaitForCredentialsAdvertisingTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c := newTestClient(ctx, t, bp.WithAdvertisingTimeout(100*time.Millisecond))
+	bwp := NewBluetoothWiFiProvisionerWithPeripheral(c.m)
+
+	if _, err := bwp.WaitForCredentials(ctx); !errors.Is(err, bp.ErrAdvertisingTimeout) {
+		t.Errorf("WaitForCredentials = %v, want %v", err, bp.ErrAdvertisingTimeout)
+	}
+	if c.m.IsAdvertising() {
+		t.Error("still advertising after the advertising window elapsed")
+	}
+}
@@ -0,0 +1,116 @@
+package bleperipheral
+
+import (
+	"path"
+	"strings"
+
+	"github.com/godbus/dbus"
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	BluezAdapter       = "org.bluez.Adapter1"
+	defaultAdapterID   = "hci0"
+	dbusObjectManager  = "org.freedesktop.DBus.ObjectManager"
+	managedObjectsCall = dbusObjectManager + ".GetManagedObjects"
+)
+
+// adapterInfo describes a bluetooth adapter known to BlueZ.
+type adapterInfo struct {
+	ID      string // E.g. hci0.
+	Path    dbus.ObjectPath
+	Address string
+	Powered bool
+
+	interfaces map[string]map[string]dbus.Variant // Properties of each interface the adapter object implements.
+}
+
+// listAdapters returns every bluetooth adapter known to BlueZ.
+func listAdapters() ([]adapterInfo, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to connect to system DBus")
+	}
+
+	var objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	if err := conn.Object(BluezDBusService, "/").Call(managedObjectsCall, 0).Store(&objects); err != nil {
+		return nil, errors.WithMessage(err, "failed to list Bluez objects")
+	}
+	var adapters []adapterInfo
+	for objectPath, interfaces := range objects {
+		props, ok := interfaces[BluezAdapter]
+		if !ok {
+			continue
+		}
+		address, _ := props["Address"].Value().(string)
+		powered, _ := props["Powered"].Value().(bool)
+		adapters = append(adapters, adapterInfo{
+			ID:      path.Base(string(objectPath)),
+			Path:    objectPath,
+			Address: address,
+			Powered: powered,
+
+			interfaces: interfaces,
+		})
+	}
+	return adapters, nil
+}
+
+// findAdapter returns the adapter with the given ID (e.g. hci1) or, if address is non-empty, the given MAC address.
+// The adapter must exist and be powered.
+func findAdapter(id, address string) (*adapterInfo, error) {
+	adapters, err := listAdapters()
+	if err != nil {
+		return nil, err
+	}
+
+	description := "adapter " + id
+	if address != "" {
+		description = "adapter with address " + address
+	}
+	for _, adapter := range adapters {
+		if address != "" && !strings.EqualFold(adapter.Address, address) {
+			continue
+		}
+		if address == "" && adapter.ID != id {
+			continue
+		}
+		if !adapter.Powered {
+			return nil, errors.Errorf("bluetooth %s (%s) is not powered", description, adapter.ID)
+		}
+		return &adapter, nil
+	}
+
+	available := make([]string, 0, len(adapters))
+	for _, adapter := range adapters {
+		available = append(available, adapter.ID+" ("+adapter.Address+")")
+	}
+	return nil, errors.Errorf("bluetooth %s not found, available adapters: [%s]", description, strings.Join(available, ", "))
+}
+
+// enableAdapter enables the given adapter.
+func enableAdapter(info *adapterInfo) (*bluetooth.Adapter, error) {
+	adapter := bluetooth.DefaultAdapter
+	if info.ID != defaultAdapterID {
+		adapter = bluetooth.NewAdapter(info.ID)
+	}
+	if err := adapter.Enable(); err != nil {
+		return nil, errors.WithMessagef(err, "failed to enable bluetooth adapter %s", info.ID)
+	}
+	return adapter, nil
+}
+
+// setAdapterPowered powers the adapter at the given object path on or off.
+func setAdapterPowered(adapterPath dbus.ObjectPath, powered bool) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return errors.WithMessage(err, "failed to connect to system DBus")
+	}
+	call := conn.Object(BluezDBusService, adapterPath).Call("org.freedesktop.DBus.Properties.Set", 0,
+		BluezAdapter, "Powered", dbus.MakeVariant(powered))
+	if call.Err != nil {
+		return errors.WithMessagef(call.Err, "failed to set Powered property of bluetooth adapter %s", adapterPath)
+	}
+	return nil
+}
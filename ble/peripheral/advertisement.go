@@ -0,0 +1,116 @@
+package bleperipheral
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+const (
+	// AdvertisementProtocolVersion is the version of the provisioning protocol announced in advertisements.
+	AdvertisementProtocolVersion = 1
+	// DefaultManufacturerCompanyID is the company ID manufacturer data is advertised under, unless overridden with
+	// WithManufacturerCompanyID. 0xffff is reserved by the Bluetooth SIG for testing.
+	DefaultManufacturerCompanyID = 0xffff
+
+	// maxAdvertisedDeviceIDLength is what fits in a 31 byte advertisement besides the flags, the 128-bit service UUID
+	// and the rest of the manufacturer data. The local name is moved to the scan response by BlueZ.
+	maxAdvertisedDeviceIDLength = 4
+)
+
+// AdvertisedState is the coarse provisioning state announced in advertisements, so that apps can filter and sort
+// devices without connecting.
+type AdvertisedState byte
+
+const (
+	AdvertisedUnprovisioned AdvertisedState = iota
+	AdvertisedProvisioning
+	AdvertisedProvisioned
+	AdvertisedError
+)
+
+// advertisedState maps a provisioning state to the state announced in advertisements.
+func advertisedState(state ProvisioningState) AdvertisedState {
+	switch state {
+	case StateWaiting:
+		return AdvertisedUnprovisioned
+	case StateConnected:
+		return AdvertisedProvisioned
+	case StateFailed:
+		return AdvertisedError
+	default:
+		return AdvertisedProvisioning
+	}
+}
+
+// ManufacturerData is the manufacturer-specific data of advertisements: the protocol version and advertised state,
+// one byte each, followed by the device ID.
+type ManufacturerData struct {
+	Version  uint8
+	State    AdvertisedState
+	DeviceID []byte
+}
+
+func (md *ManufacturerData) ToBytes() []byte {
+	return append([]byte{md.Version, byte(md.State)}, md.DeviceID...)
+}
+
+// ParseManufacturerData parses the manufacturer-specific data of an advertisement.
+func ParseManufacturerData(b []byte) (*ManufacturerData, error) {
+	if len(b) < 2 {
+		return nil, errors.Errorf("manufacturer data is %d bytes, want at least 2", len(b))
+	}
+	return &ManufacturerData{
+		Version:  b[0],
+		State:    AdvertisedState(b[1]),
+		DeviceID: append([]byte(nil), b[2:]...),
+	}, nil
+}
+
+// advertisedDeviceID returns the device ID announced in advertisements: the one configured or, by default, one unique
+// to the device. That is the start of the base UUID if it was derived from the serial number or set explicitly, or
+// else the start of the base UUID the given serial number would derive, or else the end of the adapter address. Only
+// if none of them is known is the start of the default base UUID, which every device shares, announced.
+func advertisedDeviceID(o *options, serialNumber string) ([]byte, error) {
+	if o.advertisedDeviceID != nil {
+		if len(o.advertisedDeviceID) > maxAdvertisedDeviceIDLength {
+			return nil, errors.Errorf(
+				"advertised device ID is %d bytes, at most %d fit in an advertisement",
+				len(o.advertisedDeviceID), maxAdvertisedDeviceIDLength)
+		}
+		return o.advertisedDeviceID, nil
+	}
+
+	base := o.baseUUID
+	if base == DefaultBaseUUID && serialNumber != "" {
+		base = BaseUUIDFromSerial(serialNumber)
+	}
+	if base == DefaultBaseUUID && o.localAddress != "" {
+		if hw, err := net.ParseMAC(o.localAddress); err == nil && len(hw) >= maxAdvertisedDeviceIDLength {
+			return append([]byte(nil), hw[len(hw)-maxAdvertisedDeviceIDLength:]...), nil
+		}
+	}
+	return append([]byte(nil), base[:maxAdvertisedDeviceIDLength]...), nil
+}
+
+// ManufacturerData returns the manufacturer-specific data currently advertised.
+func (ps *provisioningService) ManufacturerData() *ManufacturerData {
+	return &ManufacturerData{
+		Version:  AdvertisementProtocolVersion,
+		State:    advertisedState(ps.status.currentStatus().State),
+		DeviceID: ps.deviceID,
+	}
+}
+
+// advertisementOptions returns the advertisement announcing the service under the given local name, along with the
+// current manufacturer data.
+func (ps *provisioningService) advertisementOptions(name string) bluetooth.AdvertisementOptions {
+	return bluetooth.AdvertisementOptions{
+		LocalName:    name,
+		ServiceUUIDs: []bluetooth.UUID{ps.UUID},
+		ManufacturerData: []bluetooth.ManufacturerDataElement{
+			{CompanyID: ps.companyID, Data: ps.ManufacturerData().ToBytes()},
+		},
+	}
+}
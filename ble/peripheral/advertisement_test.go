@@ -0,0 +1,60 @@
+package bleperipheral
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAdvertisedDeviceID(t *testing.T) {
+	serialBase := BaseUUIDFromSerial("SN1234")
+	otherBase := uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef")
+	for _, tc := range []struct {
+		name         string
+		opts         []Option
+		localAddress string
+		serialNumber string
+		want         []byte
+		ok           bool
+	}{
+		{"configured", []Option{WithAdvertisedDeviceID([]byte{1, 2})}, "", "SN1234", []byte{1, 2}, true},
+		{"configured too long", []Option{WithAdvertisedDeviceID([]byte{1, 2, 3, 4, 5})}, "", "", nil, false},
+		{"serial option", []Option{WithSerialNumber("SN1234")}, "00:1A:7D:DA:71:13", "SN1234", serialBase[:4], true},
+		{"collected serial", nil, "00:1A:7D:DA:71:13", "SN1234", serialBase[:4], true},
+		{"base UUID", []Option{WithBaseUUID(otherBase)}, "00:1A:7D:DA:71:13", "", otherBase[:4], true},
+		{"adapter address", nil, "00:1A:7D:DA:71:13", "", []byte{0x7d, 0xda, 0x71, 0x13}, true},
+		{"nothing known", nil, "", "", DefaultBaseUUID[:4], true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := defaultOptions()
+			for _, opt := range tc.opts {
+				opt(o)
+			}
+			o.localAddress = tc.localAddress
+			got, err := advertisedDeviceID(o, tc.serialNumber)
+			if (err == nil) != tc.ok {
+				t.Fatalf("advertisedDeviceID = %v, want ok %t", err, tc.ok)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("advertisedDeviceID = % x, want % x", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestManufacturerDataRoundTrip(t *testing.T) {
+	md := &ManufacturerData{
+		Version: AdvertisementProtocolVersion, State: AdvertisedProvisioning, DeviceID: []byte{1, 2, 3, 4},
+	}
+	parsed, err := ParseManufacturerData(md.ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Version != md.Version || parsed.State != md.State || !bytes.Equal(parsed.DeviceID, md.DeviceID) {
+		t.Errorf("parsed %+v, want %+v", parsed, md)
+	}
+	if _, err := ParseManufacturerData([]byte{1}); err == nil {
+		t.Error("parsed truncated manufacturer data")
+	}
+}
@@ -0,0 +1,238 @@
+package bleperipheral
+
+import (
+	"strings"
+
+	"github.com/edaniels/golog"
+	"github.com/godbus/dbus"
+	"github.com/pkg/errors"
+)
+
+// AgentCapability is the IO capability the pairing agent registers with, from which BlueZ chooses the pairing method
+// (e.g. "Just Works" for NoInputNoOutput, passkey entry or numeric comparison otherwise).
+type AgentCapability string
+
+const (
+	CapabilityDisplayOnly     AgentCapability = "DisplayOnly"
+	CapabilityDisplayYesNo    AgentCapability = "DisplayYesNo"
+	CapabilityKeyboardOnly    AgentCapability = "KeyboardOnly"
+	CapabilityNoInputNoOutput AgentCapability = "NoInputNoOutput"
+	CapabilityKeyboardDisplay AgentCapability = "KeyboardDisplay"
+)
+
+const bluezErrorRejected = "org.bluez.Error.Rejected"
+
+func (c AgentCapability) validate() error {
+	switch c {
+	case CapabilityDisplayOnly, CapabilityDisplayYesNo, CapabilityKeyboardOnly, CapabilityNoInputNoOutput,
+		CapabilityKeyboardDisplay:
+		return nil
+	default:
+		return errors.Errorf("invalid pairing agent capability %q", c)
+	}
+}
+
+// checkHandler returns an error unless handler has the callbacks needed to pair with this capability, as otherwise
+// confirmation requests would be accepted without anyone confirming the passkey, and passkeys would never be shown
+// or entered. NoInputNoOutput ("Just Works") needs none.
+func (c AgentCapability) checkHandler(handler *PairingHandler) error {
+	if handler == nil {
+		handler = &PairingHandler{}
+	}
+	var missing []string
+	switch c {
+	case CapabilityDisplayOnly:
+		if handler.DisplayPasskey == nil && handler.DisplayPinCode == nil {
+			missing = append(missing, "DisplayPasskey or DisplayPinCode")
+		}
+	case CapabilityDisplayYesNo:
+		if handler.DisplayPasskey == nil {
+			missing = append(missing, "DisplayPasskey")
+		}
+		if handler.RequestConfirmation == nil {
+			missing = append(missing, "RequestConfirmation")
+		}
+	case CapabilityKeyboardOnly:
+		if handler.RequestPasskey == nil {
+			missing = append(missing, "RequestPasskey")
+		}
+	case CapabilityKeyboardDisplay:
+		if handler.RequestPasskey == nil {
+			missing = append(missing, "RequestPasskey")
+		}
+		if handler.DisplayPasskey == nil {
+			missing = append(missing, "DisplayPasskey")
+		}
+		if handler.RequestConfirmation == nil {
+			missing = append(missing, "RequestConfirmation")
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("pairing agent capability %s requires a pairing handler with %s", c,
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// PairingHandler lets the host application take part in pairing, e.g. by showing a passkey on a display. Devices are
+// identified by their MAC address. Callbacks which return an error reject the request. If a callback is nil, requests
+// for confirmation or authorization are accepted, requests for input are rejected, and everything else is logged.
+// Capabilities other than NoInputNoOutput require the callbacks they pair with to be set.
+type PairingHandler struct {
+	RequestPinCode       func(device string) (string, error)
+	DisplayPinCode       func(device, pinCode string) error
+	RequestPasskey       func(device string) (uint32, error)
+	DisplayPasskey       func(device string, passkey uint32, entered uint16)
+	RequestConfirmation  func(device string, passkey uint32) error
+	RequestAuthorization func(device string) error
+	AuthorizeService     func(device, uuid string) error
+	Cancel               func()
+}
+
+// pairingAgent implements org.bluez.Agent1, which BlueZ calls into during pairing. See:
+// https://git.kernel.org/pub/scm/bluetooth/bluez.git/tree/doc/org.bluez.Agent.rst
+type pairingAgent struct {
+	logger  golog.Logger
+	handler *PairingHandler
+	trust   *trustManager
+	limiter *rateLimiter
+}
+
+func newPairingAgent(
+	logger golog.Logger, handler *PairingHandler, trust *trustManager, limiter *rateLimiter,
+) *pairingAgent {
+	if handler == nil {
+		handler = &PairingHandler{}
+	}
+	return &pairingAgent{logger: logger, handler: handler, trust: trust, limiter: limiter}
+}
+
+// authorize rejects pairing with centrals which are locked out or which the trust policy does not allow.
+func (a *pairingAgent) authorize(mac string) *dbus.Error {
+	if err := a.limiter.checkLockout(mac); err != nil {
+		a.logger.Warnw("rejected pairing request", "device", mac, "reason", err)
+		return rejected(err)
+	}
+	if err := a.trust.canTrust(mac); err != nil {
+		a.logger.Warnw("rejected pairing request", "device", mac, "reason", err)
+		return rejected(err)
+	}
+	return nil
+}
+
+func rejected(err error) *dbus.Error {
+	return dbus.NewError(bluezErrorRejected, []interface{}{err.Error()})
+}
+
+// Release is called when BlueZ unregisters the agent.
+func (a *pairingAgent) Release() *dbus.Error {
+	a.logger.Info("Bluez agent released")
+	return nil
+}
+
+func (a *pairingAgent) RequestPinCode(device dbus.ObjectPath) (string, *dbus.Error) {
+	mac := convertDBusPathToMAC(string(device))
+	if err := a.authorize(mac); err != nil {
+		return "", err
+	}
+	if a.handler.RequestPinCode == nil {
+		a.logger.Warnw("rejected request for PIN code, no handler registered", "device", mac)
+		return "", dbus.NewError(bluezErrorRejected, nil)
+	}
+	pinCode, err := a.handler.RequestPinCode(mac)
+	if err != nil {
+		return "", rejected(err)
+	}
+	return pinCode, nil
+}
+
+func (a *pairingAgent) DisplayPinCode(device dbus.ObjectPath, pinCode string) *dbus.Error {
+	mac := convertDBusPathToMAC(string(device))
+	if a.handler.DisplayPinCode == nil {
+		a.logger.Infow("pairing PIN code requested by device, no handler registered to display it", "device", mac)
+		return nil
+	}
+	if err := a.handler.DisplayPinCode(mac, pinCode); err != nil {
+		return rejected(err)
+	}
+	return nil
+}
+
+func (a *pairingAgent) RequestPasskey(device dbus.ObjectPath) (uint32, *dbus.Error) {
+	mac := convertDBusPathToMAC(string(device))
+	if err := a.authorize(mac); err != nil {
+		return 0, err
+	}
+	if a.handler.RequestPasskey == nil {
+		a.logger.Warnw("rejected request for passkey, no handler registered", "device", mac)
+		return 0, dbus.NewError(bluezErrorRejected, nil)
+	}
+	passkey, err := a.handler.RequestPasskey(mac)
+	if err != nil {
+		return 0, rejected(err)
+	}
+	return passkey, nil
+}
+
+func (a *pairingAgent) DisplayPasskey(device dbus.ObjectPath, passkey uint32, entered uint16) *dbus.Error {
+	mac := convertDBusPathToMAC(string(device))
+	if a.handler.DisplayPasskey == nil {
+		a.logger.Infow("pairing passkey generated, no handler registered to display it", "device", mac)
+		return nil
+	}
+	a.handler.DisplayPasskey(mac, passkey, entered)
+	return nil
+}
+
+func (a *pairingAgent) RequestConfirmation(device dbus.ObjectPath, passkey uint32) *dbus.Error {
+	mac := convertDBusPathToMAC(string(device))
+	if err := a.authorize(mac); err != nil {
+		return err
+	}
+	if a.handler.RequestConfirmation == nil {
+		a.logger.Infow("confirmed pairing passkey, no handler registered", "device", mac)
+		return nil
+	}
+	if err := a.handler.RequestConfirmation(mac, passkey); err != nil {
+		return rejected(err)
+	}
+	return nil
+}
+
+func (a *pairingAgent) RequestAuthorization(device dbus.ObjectPath) *dbus.Error {
+	mac := convertDBusPathToMAC(string(device))
+	if err := a.authorize(mac); err != nil {
+		return err
+	}
+	if a.handler.RequestAuthorization == nil {
+		a.logger.Infow("authorized pairing, no handler registered", "device", mac)
+		return nil
+	}
+	if err := a.handler.RequestAuthorization(mac); err != nil {
+		return rejected(err)
+	}
+	return nil
+}
+
+func (a *pairingAgent) AuthorizeService(device dbus.ObjectPath, uuid string) *dbus.Error {
+	mac := convertDBusPathToMAC(string(device))
+	if err := a.authorize(mac); err != nil {
+		return err
+	}
+	if a.handler.AuthorizeService == nil {
+		return nil
+	}
+	if err := a.handler.AuthorizeService(mac, uuid); err != nil {
+		return rejected(err)
+	}
+	return nil
+}
+
+// Cancel is called when a request is canceled before it was answered, e.g. because the device disconnected.
+func (a *pairingAgent) Cancel() *dbus.Error {
+	a.logger.Info("pairing request canceled")
+	if a.handler.Cancel != nil {
+		a.handler.Cancel()
+	}
+	return nil
+}
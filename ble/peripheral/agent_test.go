@@ -0,0 +1,34 @@
+package bleperipheral
+
+import "testing"
+
+func TestAgentCapabilityCheckHandler(t *testing.T) {
+	displayPasskey := func(string, uint32, uint16) {}
+	requestPasskey := func(string) (uint32, error) { return 0, nil }
+	requestConfirmation := func(string, uint32) error { return nil }
+	full := &PairingHandler{
+		DisplayPasskey:      displayPasskey,
+		RequestPasskey:      requestPasskey,
+		RequestConfirmation: requestConfirmation,
+	}
+	for _, tc := range []struct {
+		capability AgentCapability
+		handler    *PairingHandler
+		ok         bool
+	}{
+		{CapabilityNoInputNoOutput, nil, true},
+		{CapabilityDisplayOnly, nil, false},
+		{CapabilityDisplayOnly, &PairingHandler{DisplayPinCode: func(string, string) error { return nil }}, true},
+		{CapabilityDisplayOnly, &PairingHandler{DisplayPasskey: displayPasskey}, true},
+		{CapabilityDisplayYesNo, &PairingHandler{RequestConfirmation: requestConfirmation}, false},
+		{CapabilityDisplayYesNo, full, true},
+		{CapabilityKeyboardOnly, &PairingHandler{}, false},
+		{CapabilityKeyboardOnly, &PairingHandler{RequestPasskey: requestPasskey}, true},
+		{CapabilityKeyboardDisplay, &PairingHandler{RequestPasskey: requestPasskey, DisplayPasskey: displayPasskey}, false},
+		{CapabilityKeyboardDisplay, full, true},
+	} {
+		if err := tc.capability.checkHandler(tc.handler); (err == nil) != tc.ok {
+			t.Errorf("%s.checkHandler(%+v) = %v, want ok %t", tc.capability, tc.handler, err, tc.ok)
+		}
+	}
+}
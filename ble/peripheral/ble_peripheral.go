@@ -5,13 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
-	"time"
 
 	"github.com/pkg/errors"
-	"go.viam.com/utils"
+	"go.uber.org/multierr"
 
 	"github.com/edaniels/golog"
-	"github.com/google/uuid"
+	"github.com/godbus/dbus"
 	"tinygo.org/x/bluetooth"
 )
 
@@ -19,193 +18,103 @@ type BLEPeripheral interface {
 	StartAdvertising(context.Context) error
 	StopAdvertising() error
 
-	UpdateAvailableWiFiNetworks(*AvailableWiFiNetworks)
+	UpdateAvailableWiFiNetworks(*AvailableWiFiNetworks) error
+	UpdateStatus(*ProvisioningStatus) error
 
-	ReadSsid() (string, error)
-	ReadPsk() (string, error)
-	ReadRobotPartKeyID() (string, error)
-	ReadRobotPartKey() (string, error)
+	// ConnectedCentrals returns the centrals currently connected, and SubscribeConnectionEvents streams their
+	// connections, disconnections and pairings until the given context is done.
+	ConnectedCentrals() []Central
+	SubscribeConnectionEvents(context.Context) <-chan ConnectionEvent
+
+	// HandleCommand registers the handler for a command written by clients to the command characteristic.
+	HandleCommand(Command, CommandHandler)
+
+	// AdvertisingTimeout returns a channel which is closed once advertising stops because the advertising window
+	// elapsed, or nil if advertising is not limited.
+	AdvertisingTimeout() <-chan struct{}
+
+	// ReadValue and WriteValue access characteristics by the name they were declared with. Prefer the typed Read and
+	// Write functions.
+	ReadValue(name string) (any, error)
+	WriteValue(name string, value any) error
 }
 
 type AvailableWiFiNetworks struct {
-	Networks []*struct {
-		Ssid        string  `json:"ssid"`
-		Strength    float64 `json:"strength"` // This float, in the inclusive range [0.0, 1.0], represents the % strength of a WiFi network.
-		RequiresPsk bool    `json:"requires_psk"`
-	} `json:"networks"`
+	Networks []*WiFiNetwork `json:"networks"`
 }
 
 func (awns *AvailableWiFiNetworks) ToBytes() ([]byte, error) {
 	return json.Marshal(awns)
 }
 
-type linuxBLECharacteristic[T any] struct {
-	UUID   bluetooth.UUID
-	mu     *sync.Mutex
-	active bool // Currently non-functional, but should be used to make characteristics optional.
-
-	currentValue T
-}
-
 type linuxBLEService struct {
+	*provisioningService
 	logger golog.Logger
 	mu     *sync.Mutex
 
-	adv       *bluetooth.Advertisement
-	advActive bool
-	UUID      bluetooth.UUID
+	name              string
+	adapterPath       dbus.ObjectPath
+	powerOffOnTimeout bool
+	poweredOff        bool
 
-	availableWiFiNetworksChannelWriteOnly chan<- *AvailableWiFiNetworks
+	adv           *bluetooth.Advertisement
+	advActive     bool
+	advState      AdvertisedState // As of the last time the advertisement was configured.
+	advGeneration uint64          // Incremented every time advertising starts.
 
-	characteristicSsid           *linuxBLECharacteristic[*string]
-	characteristicPsk            *linuxBLECharacteristic[*string]
-	characteristicRobotPartKeyID *linuxBLECharacteristic[*string]
-	characteristicRobotPartKey   *linuxBLECharacteristic[*string]
+	agent           *pairingAgent
+	agentCapability AgentCapability
+	agentRegistered bool // Only while advertising.
 }
 
-func NewLinuxBLEPeripheral(ctx context.Context, logger golog.Logger, name string) (BLEPeripheral, error) {
-	if err := validateSystem(logger); err != nil {
+// NewLinuxBLEPeripheral returns a BLE peripheral which advertises the provisioning service via BlueZ. All GATT UUIDs are
+// derived from DefaultBaseUUID unless overridden with WithBaseUUID or WithSerialNumber, and the adapter used is hci0
+// unless overridden with WithAdapterID or WithAdapterAddress.
+func NewLinuxBLEPeripheral(ctx context.Context, logger golog.Logger, name string, opts ...Option) (BLEPeripheral, error) {
+	if err := checkOS(); err != nil {
 		return nil, errors.WithMessage(err, "cannot initialize bluetooth peripheral, system requisites not met")
 	}
+	logger.Info("✅ Running on a Linux system.")
 
-	adapter := bluetooth.DefaultAdapter
-	if err := adapter.Enable(); err != nil {
-		return nil, errors.WithMessage(err, "failed to enable bluetooth adapter")
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	if err := o.agentCapability.validate(); err != nil {
+		return nil, err
+	}
+	if err := o.agentCapability.checkHandler(o.pairingHandler); err != nil {
+		return nil, err
+	}
+	adapterInfo, err := findAdapter(o.adapterID, o.adapterAddress)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to select bluetooth adapter")
+	}
+	if _, err := validateSystem(logger, adapterInfo); err != nil {
+		return nil, errors.WithMessage(err, "cannot initialize bluetooth peripheral, system requisites not met")
+	}
+	adapter, err := enableAdapter(adapterInfo)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("using bluetooth adapter %s (%s)", adapterInfo.ID, adapterInfo.Address)
+	o.localAddress = adapterInfo.Address
+	if o.deviceInfo == nil {
+		o.deviceInfo = collectDeviceInfo(logger, o.serialNumber)
 	}
 
-	serviceUUID := bluetooth.NewUUID(uuid.New()).Replace16BitComponent(0x1111)
-	logger.Infof("serviceUUID: %s", serviceUUID.String())
-	charSsidUUID := bluetooth.NewUUID(uuid.New()).Replace16BitComponent(0x2222)
-	logger.Infof("charSsidUUID: %s", charSsidUUID.String())
-	charPskUUID := bluetooth.NewUUID(uuid.New()).Replace16BitComponent(0x3333)
-	logger.Infof("charPskUUID: %s", charPskUUID.String())
-	charRobotPartKeyIDUUID := bluetooth.NewUUID(uuid.New()).Replace16BitComponent(0x4444)
-	logger.Infof("charRobotPartKeyIDUUID: %s", charRobotPartKeyIDUUID.String())
-	charRobotPartKeyUUID := bluetooth.NewUUID(uuid.New()).Replace16BitComponent(0x5555)
-	logger.Infof("charRobotPartKeyUUID: %s", charRobotPartKeyUUID.String())
-	charAvailableWiFiNetworksUUID := bluetooth.NewUUID(uuid.New()).Replace16BitComponent(0x6666)
-	logger.Infof("charAvailableWiFiNetworksUUID: %s", charAvailableWiFiNetworksUUID.String())
-
-	// Create abstracted characteristics which act as a buffer for reading data from bluetooth.
-	charSsid := &linuxBLECharacteristic[*string]{
-		UUID:         charSsidUUID,
-		mu:           &sync.Mutex{},
-		active:       true,
-		currentValue: nil,
-	}
-	charPsk := &linuxBLECharacteristic[*string]{
-		UUID:         charPskUUID,
-		mu:           &sync.Mutex{},
-		active:       true,
-		currentValue: nil,
-	}
-	charRobotPartKeyID := &linuxBLECharacteristic[*string]{
-		UUID:         charRobotPartKeyIDUUID,
-		mu:           &sync.Mutex{},
-		active:       true,
-		currentValue: nil,
-	}
-	charRobotPartKey := &linuxBLECharacteristic[*string]{
-		UUID:         charRobotPartKeyUUID,
-		mu:           &sync.Mutex{},
-		active:       true,
-		currentValue: nil,
-	}
-
-	// Create write-only, locking characteristics (one per credential) for fields that are written to.
-	charConfigSsid := bluetooth.CharacteristicConfig{
-		UUID:  charSsidUUID,
-		Flags: bluetooth.CharacteristicWritePermission,
-		WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-			v := string(value)
-			logger.Infof("Received SSID: %s", v)
-			charSsid.mu.Lock()
-			defer charSsid.mu.Unlock()
-			charSsid.currentValue = &v
-		},
-	}
-	charConfigPsk := bluetooth.CharacteristicConfig{
-		UUID:  charPskUUID,
-		Flags: bluetooth.CharacteristicWritePermission,
-		WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-			v := string(value)
-			logger.Infof("Received Passkey: %s", v)
-			charPsk.mu.Lock()
-			defer charPsk.mu.Unlock()
-			charPsk.currentValue = &v
-		},
-	}
-	charConfigRobotPartKeyID := bluetooth.CharacteristicConfig{
-		UUID:  charRobotPartKeyIDUUID,
-		Flags: bluetooth.CharacteristicWritePermission,
-		WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-			v := string(value)
-			logger.Infof("Received Robot Part Key ID: %s", v)
-			charRobotPartKeyID.mu.Lock()
-			defer charRobotPartKeyID.mu.Unlock()
-			charRobotPartKeyID.currentValue = &v
-		},
-	}
-	charConfigRobotPartKey := bluetooth.CharacteristicConfig{
-		UUID:  charRobotPartKeyUUID,
-		Flags: bluetooth.CharacteristicWritePermission,
-		WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
-			v := string(value)
-			logger.Infof("Received Robot Part Key: %s", v)
-			charRobotPartKey.mu.Lock()
-			defer charRobotPartKey.mu.Unlock()
-			charRobotPartKey.currentValue = &v
-		},
-	}
-
-	// Create a read-only characteristic for broadcasting nearby, available WiFi networks.
-	charConfigAvailableWiFiNetworks := bluetooth.CharacteristicConfig{
-		UUID:       charAvailableWiFiNetworksUUID,
-		Flags:      bluetooth.CharacteristicReadPermission,
-		Value:      nil, // This will get filled in via calls to UpdateAvailableWiFiNetworks.
-		WriteEvent: nil, // This characteristic is read-only.
-	}
-
-	// Channel will be written to by interface method UpdateAvailableWiFiNetworks and will be read by
-	// the following background goroutine
-	availableWiFiNetworksChannel := make(chan *AvailableWiFiNetworks, 1)
-
-	// Read only channel used to listen for updates to the availableWiFiNetworks.
-	var availableWiFiNetworksChannelReadOnly <-chan *AvailableWiFiNetworks = availableWiFiNetworksChannel
-	utils.ManagedGo(func() {
-		for {
-			if err := ctx.Err(); err != nil {
-				return
-			}
-			select {
-			case <-ctx.Done():
-				return
-			case awns := <-availableWiFiNetworksChannelReadOnly:
-				bs, err := awns.ToBytes()
-				if err != nil {
-					logger.Errorw("failed to cast available WiFi networks to bytes before writing to bluetooth characteristic")
-				}
-				charConfigAvailableWiFiNetworks.Value = bs
-				logger.Infow("successfully updated available WiFi networks on bluetooth characteristic")
-			default:
-				time.Sleep(time.Second)
-			}
-		}
-	}, nil)
-
-	// Create service which will advertise each of the above characteristics.
-	s := &bluetooth.Service{
-		UUID: serviceUUID,
-		Characteristics: []bluetooth.CharacteristicConfig{
-			charConfigSsid,
-			charConfigPsk,
-			charConfigRobotPartKeyID,
-			charConfigRobotPartKey,
-			charConfigAvailableWiFiNetworks,
-		},
+	ps, err := newProvisioningService(ctx, logger, o)
+	if err != nil {
+		return nil, err
 	}
+
+	// Create service which will advertise each of the provisioning characteristics.
+	s := ps.bluetoothService()
 	if err := adapter.AddService(s); err != nil {
-		return nil, errors.WithMessage(err, "unable to add bluetooth service to default adapter")
+		return nil, errors.WithMessagef(err, "unable to add bluetooth service to adapter %s", adapterInfo.ID)
+	}
+	if err := ps.bindHandles(s); err != nil {
+		return nil, err
 	}
 	if err := adapter.Enable(); err != nil {
 		return nil, errors.WithMessage(err, "failed to enable bluetooth adapter")
@@ -214,29 +123,41 @@ func NewLinuxBLEPeripheral(ctx context.Context, logger golog.Logger, name string
 	if defaultAdvertisement == nil {
 		return nil, errors.New("default advertisement is nil")
 	}
-	if err := defaultAdvertisement.Configure(
-		bluetooth.AdvertisementOptions{
-			LocalName:    name,
-			ServiceUUIDs: []bluetooth.UUID{serviceUUID},
-		},
-	); err != nil {
+	if err := defaultAdvertisement.Configure(ps.advertisementOptions(name)); err != nil {
 		return nil, errors.WithMessage(err, "failed to configure default advertisement")
 	}
-	return &linuxBLEService{
-		logger: logger,
-		mu:     &sync.Mutex{},
+	trust := newTrustManager(logger, o.trustPolicy, adapterInfo.Path)
+	ps.limiter.setDisconnect(func(address string) error {
+		devicePath, err := deviceObjectPath(adapterInfo.Path, address)
+		if err != nil {
+			return err
+		}
+		return disconnectDevice(devicePath)
+	})
+	agent := newPairingAgent(logger, o.pairingHandler, trust, ps.limiter)
+	if _, err := startConnectionListener(ctx, logger, agent, ps.centrals); err != nil {
+		logger.Errorw("failed to listen for connection events (connected centrals will not be tracked)", "err", err)
+	}
+	lbs := &linuxBLEService{
+		provisioningService: ps,
+		logger:              logger,
+		mu:                  &sync.Mutex{},
+
+		name:              name,
+		adapterPath:       adapterInfo.Path,
+		powerOffOnTimeout: o.powerOffOnTimeout,
 
 		adv:       defaultAdvertisement,
 		advActive: false,
-		UUID:      serviceUUID,
+		advState:  ps.ManufacturerData().State,
 
-		availableWiFiNetworksChannelWriteOnly: availableWiFiNetworksChannel,
-
-		characteristicSsid:           charSsid,
-		characteristicPsk:            charPsk,
-		characteristicRobotPartKeyID: charRobotPartKeyID,
-		characteristicRobotPartKey:   charRobotPartKey,
-	}, nil
+		agent:           agent,
+		agentCapability: o.agentCapability,
+	}
+	ps.commands.setReset(func() error {
+		return ps.resetSession(lbs.UpdateStatus)
+	})
+	return lbs, nil
 }
 
 func (s *linuxBLEService) StartAdvertising(ctx context.Context) error {
@@ -249,17 +170,26 @@ func (s *linuxBLEService) StartAdvertising(ctx context.Context) error {
 	if s.advActive {
 		return errors.New("invalid request, advertising already active")
 	}
+	if s.poweredOff {
+		if err := setAdapterPowered(s.adapterPath, true); err != nil {
+			return err
+		}
+		s.poweredOff = false
+	}
 	if err := s.adv.Start(); err != nil {
 		return errors.WithMessage(err, "failed to start advertising")
 	}
-	utils.ManagedGo(func() {
-		if err := listenForPairing(s.logger); err != nil {
-			s.logger.Errorw(
-				"failed to listen for pairing request (will have to manually accept pairing request on device)",
-				"err", err)
-		}
-	}, nil)
+	if err := registerAgent(s.logger, s.agent, s.agentCapability); err != nil {
+		s.logger.Errorw(
+			"failed to listen for pairing request (will have to manually accept pairing request on device)",
+			"err", err)
+	} else {
+		s.agentRegistered = true
+	}
 	s.advActive = true
+	s.advGeneration++
+	generation := s.advGeneration
+	s.window.open(func() { s.expireAdvertising(generation) })
 	s.logger.Info("started advertising a BLE connection...")
 	return nil
 }
@@ -267,7 +197,10 @@ func (s *linuxBLEService) StartAdvertising(ctx context.Context) error {
 func (s *linuxBLEService) StopAdvertising() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.stopAdvertisingLocked()
+}
 
+func (s *linuxBLEService) stopAdvertisingLocked() error {
 	if s.adv == nil {
 		return errors.New("advertisement is nil")
 	}
@@ -278,92 +211,120 @@ func (s *linuxBLEService) StopAdvertising() error {
 		return errors.WithMessage(err, "failed to stop advertising")
 	}
 	s.advActive = false
+	s.window.close()
 	s.logger.Info("stopped advertising a BLE connection")
+	if s.agentRegistered {
+		if err := unregisterAgent(s.logger); err != nil {
+			s.logger.Warnw("failed to stop listening for pairing requests", "err", err)
+		}
+		s.agentRegistered = false
+	}
+	if err := s.resetAuthentication(); err != nil {
+		s.logger.Warnw("failed to reset client authentication", "err", err)
+	}
+	// Centrals still connected are waiting for the outcome of provisioning, so their trust is only revoked once it
+	// completes.
+	var connected []string
+	for _, central := range s.ConnectedCentrals() {
+		connected = append(connected, central.Address)
+	}
+	if err := s.agent.trust.revokeSessionTrust(connected...); err != nil {
+		s.logger.Warnw("failed to revoke trust of centrals", "err", err)
+	}
 	return nil
 }
 
-func (s *linuxBLEService) UpdateAvailableWiFiNetworks(awns *AvailableWiFiNetworks) {
-	s.availableWiFiNetworksChannelWriteOnly <- awns
-}
-
-type ErrBLECharNoValue struct {
-	missingValue string
-}
-
-func (e *ErrBLECharNoValue) Error() string {
-	return fmt.Sprintf("No value has been written to BLE characteristic for %s", e.missingValue)
-}
+// expireAdvertising stops advertising at the end of the advertising window opened as advertising started (for the
+// given generation) and, if configured, powers the adapter off. Nothing is done if advertising was stopped in the
+// meantime, even if it started again since, as it was then stopped on purpose rather than left to time out.
+func (s *linuxBLEService) expireAdvertising(generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-func newErrBLECharNoValue(missingValue string) error {
-	return &ErrBLECharNoValue{
-		missingValue: missingValue,
+	if !s.advActive || s.advGeneration != generation {
+		s.logger.Info("advertising window elapsed after advertising was stopped")
+		return
 	}
-}
-
-func (s *linuxBLEService) ReadSsid() (string, error) {
-	if s.characteristicSsid == nil {
-		return "", errors.New("characteristic ssid is nil")
+	s.logger.Info("advertising window elapsed")
+	if err := s.stopAdvertisingLocked(); err != nil {
+		s.logger.Warnw("failed to stop advertising at the end of the advertising window", "err", err)
+		return
 	}
-
-	s.characteristicSsid.mu.Lock()
-	defer s.characteristicSsid.mu.Unlock()
-
-	if !s.characteristicSsid.active {
-		return "", errors.New("characteristic ssid is inactive")
+	if !s.powerOffOnTimeout {
+		return
 	}
-	if s.characteristicSsid.currentValue == nil {
-		return "", newErrBLECharNoValue("ssid")
+	if err := setAdapterPowered(s.adapterPath, false); err != nil {
+		s.logger.Warnw("failed to power off bluetooth adapter", "err", err)
+		return
 	}
-	return *s.characteristicSsid.currentValue, nil
+	s.poweredOff = true
+	s.logger.Info("powered off bluetooth adapter")
 }
 
-func (s *linuxBLEService) ReadPsk() (string, error) {
-	if s.characteristicPsk == nil {
-		return "", errors.New("characteristic psk is nil")
-	}
-
-	s.characteristicPsk.mu.Lock()
-	defer s.characteristicPsk.mu.Unlock()
-
-	if !s.characteristicPsk.active {
-		return "", errors.New("characteristic psk is inactive")
+// UpdateStatus updates the provisioning status, announces it in the advertisement and, once provisioning completes
+// (StateConnected, the only terminal state), revokes the trust of centrals granted for the session. This disconnects
+// them, so it is done only after the status was published. An error is returned if the status was published but could
+// not be announced, in which case advertising may have stopped.
+func (s *linuxBLEService) UpdateStatus(status *ProvisioningStatus) error {
+	if err := s.provisioningService.UpdateStatus(status); err != nil {
+		return err
+	}
+	advErr := s.updateAdvertisement()
+	if status.State == StateConnected {
+		if err := s.agent.trust.revokeSessionTrust(); err != nil {
+			s.logger.Warnw("failed to revoke trust of centrals", "err", err)
+		}
 	}
-	if s.characteristicPsk.currentValue == nil {
-		return "", newErrBLECharNoValue("psk")
+	if advErr != nil {
+		return errors.WithMessage(advErr, "failed to announce provisioning status in advertisement")
 	}
-	return *s.characteristicPsk.currentValue, nil
+	return nil
 }
 
-func (s *linuxBLEService) ReadRobotPartKeyID() (string, error) {
-	if s.characteristicRobotPartKeyID == nil {
-		return "", errors.New("characteristic robot part key ID is nil")
-	}
-
-	s.characteristicRobotPartKeyID.mu.Lock()
-	defer s.characteristicRobotPartKeyID.mu.Unlock()
+// updateAdvertisement reconfigures the advertisement if the advertised state changed. BlueZ only reads advertisement
+// data when it is registered, so an active advertisement is restarted. If it cannot be, advertising stops: the pairing
+// agent is unregistered and the advertising window closed, so that it does not power the adapter off later.
+func (s *linuxBLEService) updateAdvertisement() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if !s.characteristicRobotPartKeyID.active {
-		return "", errors.New("characteristic robot part key ID is inactive")
+	state := s.ManufacturerData().State
+	if state == s.advState {
+		return nil
+	}
+	if s.advActive {
+		if err := s.adv.Stop(); err != nil {
+			return errors.WithMessage(err, "failed to stop advertising")
+		}
+	}
+	if err := s.adv.Configure(s.advertisementOptions(s.name)); err != nil {
+		return errors.WithMessage(err, "failed to configure advertisement")
 	}
-	if s.characteristicRobotPartKeyID.currentValue == nil {
-		return "", newErrBLECharNoValue("robot part key ID")
+	s.advState = state
+	if s.advActive {
+		if err := s.adv.Start(); err != nil {
+			s.advActive = false
+			s.window.close()
+			if s.agentRegistered {
+				err = multierr.Combine(err, unregisterAgent(s.logger))
+				s.agentRegistered = false
+			}
+			return errors.WithMessage(err, "failed to restart advertising")
+		}
 	}
-	return *s.characteristicRobotPartKeyID.currentValue, nil
+	return nil
 }
 
-func (s *linuxBLEService) ReadRobotPartKey() (string, error) {
-	if s.characteristicRobotPartKey == nil {
-		return "", errors.New("characteristic robot part key is nil")
-	}
+type ErrBLECharNoValue struct {
+	missingValue string
+}
 
-	s.characteristicRobotPartKey.mu.Lock()
-	defer s.characteristicRobotPartKey.mu.Unlock()
+func (e *ErrBLECharNoValue) Error() string {
+	return fmt.Sprintf("No value has been written to BLE characteristic for %s", e.missingValue)
+}
 
-	if !s.characteristicRobotPartKey.active {
-		return "", errors.New("characteristic robot part key is inactive")
-	}
-	if s.characteristicRobotPartKey.currentValue == nil {
-		return "", newErrBLECharNoValue("robot part key")
+func newErrBLECharNoValue(missingValue string) error {
+	return &ErrBLECharNoValue{
+		missingValue: missingValue,
 	}
-	return *s.characteristicRobotPartKey.currentValue, nil
 }
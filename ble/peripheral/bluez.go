@@ -0,0 +1,157 @@
+package bleperipheral
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	BluezLEAdvertisingManager = "org.bluez.LEAdvertisingManager1"
+	BluezGattManager          = "org.bluez.GattManager1"
+
+	// BlueZ identifies itself with the Linux Foundation vendor ID and its own product ID in the modalias of adapters.
+	bluezModaliasVendor  = 0x1d6b
+	bluezModaliasProduct = 0x0246
+)
+
+// MinBlueZVersion is the oldest BlueZ release supported.
+var MinBlueZVersion = BlueZVersion{Major: 5, Minor: 66}
+
+// BlueZVersion is a BlueZ release version, e.g. 5.66.
+type BlueZVersion struct {
+	Major int
+	Minor int
+}
+
+func (v BlueZVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// AtLeast returns whether v is the same release as other or a later one.
+func (v BlueZVersion) AtLeast(other BlueZVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	return v.Minor >= other.Minor
+}
+
+// ParseBlueZVersion parses a version such as "5.66", or the output of `bluetoothctl --version` ("bluetoothctl: 5.66").
+func ParseBlueZVersion(s string) (BlueZVersion, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return BlueZVersion{}, errors.New("failed to parse BlueZ version: empty output")
+	}
+	parts := strings.Split(fields[len(fields)-1], ".")
+	if len(parts) != 2 {
+		return BlueZVersion{}, errors.Errorf("failed to parse BlueZ version: %s", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return BlueZVersion{}, errors.Errorf("failed to parse BlueZ version: %s", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return BlueZVersion{}, errors.Errorf("failed to parse BlueZ version: %s", s)
+	}
+	return BlueZVersion{Major: major, Minor: minor}, nil
+}
+
+// versionFromModalias reads the BlueZ version from the modalias of an adapter, e.g. usb:v1D6Bp0246d0542 for 5.66,
+// where the device field is the major version in the high byte and the minor version in the low byte. It fails if the
+// device ID was overridden in the BlueZ configuration.
+func versionFromModalias(modalias string) (BlueZVersion, error) {
+	var vendor, product, device uint16
+	if _, err := fmt.Sscanf(modalias, "usb:v%04Xp%04Xd%04X", &vendor, &product, &device); err != nil {
+		return BlueZVersion{}, errors.Errorf("failed to parse adapter modalias %q", modalias)
+	}
+	if vendor != bluezModaliasVendor || product != bluezModaliasProduct {
+		return BlueZVersion{}, errors.Errorf("adapter modalias %q does not identify BlueZ", modalias)
+	}
+	return BlueZVersion{Major: int(device >> 8), Minor: int(device & 0xff)}, nil
+}
+
+// versionFromCommand retrieves the BlueZ version from bluetoothctl or, failing that, bluetoothd.
+func versionFromCommand() (BlueZVersion, string, error) {
+	for _, name := range []string{"bluetoothctl", "bluetoothd"} {
+		var out bytes.Buffer
+		cmd := exec.Command(name, "--version")
+		cmd.Stdout = &out
+		if err := cmd.Run(); err != nil {
+			continue
+		}
+		version, err := ParseBlueZVersion(out.String())
+		return version, name, err
+	}
+	return BlueZVersion{}, "", errors.New("BlueZ is not installed or not accessible")
+}
+
+// BlueZCapabilities describes the BlueZ installation and what it supports on a given adapter.
+type BlueZCapabilities struct {
+	Adapter        string
+	AdapterAddress string
+	AdapterPowered bool
+
+	Version       BlueZVersion
+	VersionSource string // "dbus" if read from the adapter modalias, else the command it was read from.
+
+	LEAdvertisingManager bool
+	GattManager          bool
+	AdvertisingInstances int      // How many advertisements may be registered at once, if known.
+	ExperimentalFeatures []string // UUIDs of the experimental features enabled, if the adapter reports them.
+}
+
+// ProbeBlueZ reports the BlueZ version and capabilities of the adapter with the given ID (e.g. hci0).
+func ProbeBlueZ(adapterID string) (*BlueZCapabilities, error) {
+	adapters, err := listAdapters()
+	if err != nil {
+		return nil, err
+	}
+	for _, adapter := range adapters {
+		if adapter.ID == adapterID {
+			return probeBlueZ(&adapter)
+		}
+	}
+	return nil, errors.Errorf("bluetooth adapter %s not found", adapterID)
+}
+
+func probeBlueZ(adapter *adapterInfo) (*BlueZCapabilities, error) {
+	caps := &BlueZCapabilities{Adapter: adapter.ID, AdapterAddress: adapter.Address, AdapterPowered: adapter.Powered}
+
+	props := adapter.interfaces[BluezAdapter]
+	modalias, _ := props["Modalias"].Value().(string)
+	if version, err := versionFromModalias(modalias); err == nil {
+		caps.Version, caps.VersionSource = version, "dbus"
+	} else {
+		if caps.Version, caps.VersionSource, err = versionFromCommand(); err != nil {
+			return nil, err
+		}
+	}
+	caps.ExperimentalFeatures, _ = props["ExperimentalFeatures"].Value().([]string)
+
+	if advProps, ok := adapter.interfaces[BluezLEAdvertisingManager]; ok {
+		caps.LEAdvertisingManager = true
+		instances, _ := advProps["SupportedInstances"].Value().(byte)
+		caps.AdvertisingInstances = int(instances)
+	}
+	_, caps.GattManager = adapter.interfaces[BluezGattManager]
+	return caps, nil
+}
+
+// check returns an error if the capabilities do not meet the requirements of a BLE peripheral.
+func (c *BlueZCapabilities) check() error {
+	if !c.Version.AtLeast(MinBlueZVersion) {
+		return errors.Errorf("BlueZ version is %s, but %s or later is required", c.Version, MinBlueZVersion)
+	}
+	if !c.LEAdvertisingManager {
+		return errors.Errorf("bluetooth adapter %s does not support LE advertising (no %s)", c.Adapter, BluezLEAdvertisingManager)
+	}
+	if !c.GattManager {
+		return errors.Errorf("bluetooth adapter %s does not support GATT services (no %s)", c.Adapter, BluezGattManager)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package bleperipheral
+
+import "testing"
+
+func TestParseBlueZVersion(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want BlueZVersion
+		ok   bool
+	}{
+		{"5.66", BlueZVersion{5, 66}, true},
+		{"bluetoothctl: 5.72\n", BlueZVersion{5, 72}, true},
+		{"5.9", BlueZVersion{5, 9}, true},
+		{"", BlueZVersion{}, false},
+		{"bluetoothctl:", BlueZVersion{}, false},
+		{"5", BlueZVersion{}, false},
+		{"5.66.1", BlueZVersion{}, false},
+		{"five.66", BlueZVersion{}, false},
+		{"5.x", BlueZVersion{}, false},
+	} {
+		got, err := ParseBlueZVersion(tc.s)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseBlueZVersion(%q) = %s, %v, want %s, ok %t", tc.s, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestVersionFromModalias(t *testing.T) {
+	for _, tc := range []struct {
+		modalias string
+		want     BlueZVersion
+		ok       bool
+	}{
+		{"usb:v1D6Bp0246d0542", BlueZVersion{5, 66}, true},
+		{"usb:v1d6bp0246d0548", BlueZVersion{5, 72}, true},
+		{"usb:v1D6Bp0246d0537", BlueZVersion{5, 55}, true},
+		{"usb:v1D6Bp0001d0542", BlueZVersion{}, false},
+		{"usb:v05ACp0246d0542", BlueZVersion{}, false},
+		{"bluetooth:v1D6Bp0246d0542", BlueZVersion{}, false},
+		{"", BlueZVersion{}, false},
+	} {
+		got, err := versionFromModalias(tc.modalias)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("versionFromModalias(%q) = %s, %v, want %s, ok %t", tc.modalias, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestBlueZCapabilitiesCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		caps BlueZCapabilities
+		ok   bool
+	}{
+		{"supported", BlueZCapabilities{Version: BlueZVersion{5, 66}, LEAdvertisingManager: true, GattManager: true}, true},
+		{"newer", BlueZCapabilities{Version: BlueZVersion{6, 0}, LEAdvertisingManager: true, GattManager: true}, true},
+		{"too old", BlueZCapabilities{Version: BlueZVersion{5, 65}, LEAdvertisingManager: true, GattManager: true}, false},
+		{"no advertising", BlueZCapabilities{Version: BlueZVersion{5, 66}, GattManager: true}, false},
+		{"no GATT", BlueZCapabilities{Version: BlueZVersion{5, 66}, LEAdvertisingManager: true}, false},
+	} {
+		if err := tc.caps.check(); (err == nil) != tc.ok {
+			t.Errorf("%s: check() = %v, want ok %t", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package bleperipheral
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edaniels/golog"
+)
+
+// connectionEventBuffer is how many events a subscriber may fall behind by before further events are dropped.
+const connectionEventBuffer = 16
+
+// Central is a client connected to the peripheral.
+type Central struct {
+	Address     string
+	ConnectedAt time.Time
+	MTU         int // Zero if the negotiated ATT MTU is not known, which is always the case with BlueZ.
+	Paired      bool
+}
+
+// ConnectionEventType is the kind of change a ConnectionEvent reports.
+type ConnectionEventType string
+
+const (
+	EventConnected    ConnectionEventType = "connected"
+	EventDisconnected ConnectionEventType = "disconnected"
+	EventPaired       ConnectionEventType = "paired"
+)
+
+// ConnectionEvent reports a central connecting, disconnecting or pairing.
+type ConnectionEvent struct {
+	Type    ConnectionEventType
+	Central Central // The central as of the event.
+	Time    time.Time
+}
+
+// centralTracker keeps track of connected centrals and fans connection events out to subscribers.
+type centralTracker struct {
+	logger golog.Logger
+
+	mu             *sync.Mutex
+	centrals       map[string]*Central // By upper-case address.
+	subscribers    map[chan ConnectionEvent]struct{}
+	lastDisconnect func() // Set by the provisioning service, to end the session once every central disconnected.
+}
+
+func newCentralTracker(logger golog.Logger) *centralTracker {
+	return &centralTracker{
+		logger:      logger,
+		mu:          &sync.Mutex{},
+		centrals:    map[string]*Central{},
+		subscribers: map[chan ConnectionEvent]struct{}{},
+	}
+}
+
+// setLastDisconnect sets what is done once the last connected central disconnects. It is called synchronously, with
+// the lock held so that no central connects in the meantime, and so must not call back into the tracker.
+func (ct *centralTracker) setLastDisconnect(lastDisconnect func()) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.lastDisconnect = lastDisconnect
+}
+
+// connected records that the central with the given address connected.
+func (ct *centralTracker) connected(address string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	key := strings.ToUpper(address)
+	if _, ok := ct.centrals[key]; ok {
+		return
+	}
+	central := &Central{Address: address, ConnectedAt: time.Now()}
+	ct.centrals[key] = central
+	ct.publishLocked(EventConnected, *central)
+}
+
+// disconnected records that the central with the given address disconnected.
+func (ct *centralTracker) disconnected(address string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	key := strings.ToUpper(address)
+	central, ok := ct.centrals[key]
+	if !ok {
+		return
+	}
+	delete(ct.centrals, key)
+	ct.publishLocked(EventDisconnected, *central)
+	if len(ct.centrals) == 0 && ct.lastDisconnect != nil {
+		ct.lastDisconnect()
+	}
+}
+
+// paired records that the central with the given address paired.
+func (ct *centralTracker) paired(address string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	central, ok := ct.centrals[strings.ToUpper(address)]
+	if !ok || central.Paired {
+		return
+	}
+	central.Paired = true
+	ct.publishLocked(EventPaired, *central)
+}
+
+// setMTU records the ATT MTU negotiated with the central with the given address.
+func (ct *centralTracker) setMTU(address string, mtu int) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if central, ok := ct.centrals[strings.ToUpper(address)]; ok {
+		central.MTU = mtu
+	}
+}
+
+func (ct *centralTracker) publishLocked(eventType ConnectionEventType, central Central) {
+	event := ConnectionEvent{Type: eventType, Central: central, Time: time.Now()}
+	ct.logger.Infow("central "+string(eventType), "device", central.Address)
+	for ch := range ct.subscribers {
+		select {
+		case ch <- event:
+		default:
+			ct.logger.Warnw("dropped connection event, subscriber is not keeping up", "event", eventType)
+		}
+	}
+}
+
+// connectedCentrals returns the centrals currently connected, ordered by when they connected.
+func (ct *centralTracker) connectedCentrals() []Central {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	centrals := make([]Central, 0, len(ct.centrals))
+	for _, central := range ct.centrals {
+		centrals = append(centrals, *central)
+	}
+	sort.Slice(centrals, func(i, j int) bool {
+		return centrals[i].ConnectedAt.Before(centrals[j].ConnectedAt)
+	})
+	return centrals
+}
+
+// subscribe returns a channel of connection events from now on, which is closed once ctx is done.
+func (ct *centralTracker) subscribe(ctx context.Context) <-chan ConnectionEvent {
+	ch := make(chan ConnectionEvent, connectionEventBuffer)
+	ct.mu.Lock()
+	ct.subscribers[ch] = struct{}{}
+	ct.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		ct.mu.Lock()
+		defer ct.mu.Unlock()
+		delete(ct.subscribers, ch)
+		close(ch)
+	})
+	return ch
+}
@@ -0,0 +1,44 @@
+package bleperipheral
+
+import (
+	"context"
+	"testing"
+
+	"github.com/edaniels/golog"
+)
+
+func TestCentralTrackerEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ct := newCentralTracker(golog.NewTestLogger(t))
+	events := ct.subscribe(ctx)
+	address := convertDBusPathToMAC("/org/bluez/hci0/dev_AC_DE_48_00_11_22")
+
+	ct.paired(address) // Not connected yet, so ignored.
+	ct.connected(address)
+	ct.paired(address)
+	ct.paired(address)
+	ct.setMTU(address, 185)
+	if centrals := ct.connectedCentrals(); len(centrals) != 1 ||
+		centrals[0].Address != "AC:DE:48:00:11:22" || !centrals[0].Paired || centrals[0].MTU != 185 {
+		t.Fatalf("connected centrals = %+v", centrals)
+	}
+	ct.disconnected(address)
+	ct.disconnected(address)
+	if centrals := ct.connectedCentrals(); len(centrals) != 0 {
+		t.Fatalf("connected centrals after disconnecting = %+v", centrals)
+	}
+
+	for _, want := range []ConnectionEventType{EventConnected, EventPaired, EventDisconnected} {
+		event := <-events
+		if event.Type != want || event.Central.Address != address {
+			t.Errorf("got %s event for %q, want %s event for %q", event.Type, event.Central.Address, want, address)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected %s event", event.Type)
+	default:
+	}
+}
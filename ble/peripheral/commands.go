@@ -0,0 +1,91 @@
+package bleperipheral
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Command is an action a client requests by writing its name to the command characteristic.
+type Command string
+
+const (
+	// CommandResetSession clears every value written by clients and returns to StateWaiting, so that wrong
+	// credentials can be corrected. It is handled by the peripheral before being passed to its handler, if any.
+	CommandResetSession Command = "reset-session"
+	CommandRescan       Command = "rescan"      // Scan for Wi-Fi networks again.
+	CommandConnectNow   Command = "connect-now" // Connect with the credentials received so far.
+	CommandCancel       Command = "cancel"      // Give up provisioning.
+	CommandReboot       Command = "reboot"      // Reboot the device.
+)
+
+// CommandHandler carries out a command. An error it returns is published to the client as the reason the command was
+// rejected. Handlers are called as commands are written, so they should return promptly.
+type CommandHandler func() error
+
+func parseCommand(value string) (Command, error) {
+	command := Command(strings.TrimSpace(strings.TrimRight(value, "\x00")))
+	switch command {
+	case CommandResetSession, CommandRescan, CommandConnectNow, CommandCancel, CommandReboot:
+		return command, nil
+	default:
+		return "", errors.Errorf("unknown command %q", command)
+	}
+}
+
+// commandDispatcher passes commands written by clients to the handlers registered for them.
+type commandDispatcher struct {
+	mu       *sync.Mutex
+	handlers map[Command]CommandHandler
+	reset    func() error // Clears the session before CommandResetSession is passed to its handler.
+}
+
+func newCommandDispatcher() *commandDispatcher {
+	return &commandDispatcher{mu: &sync.Mutex{}, handlers: map[Command]CommandHandler{}}
+}
+
+// handle registers the handler for a command, replacing any registered before. A nil handler unregisters it.
+func (cd *commandDispatcher) handle(command Command, handler CommandHandler) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	if handler == nil {
+		delete(cd.handlers, command)
+		return
+	}
+	cd.handlers[command] = handler
+}
+
+// setReset sets how the session is cleared on CommandResetSession.
+func (cd *commandDispatcher) setReset(reset func() error) {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	cd.reset = reset
+}
+
+// dispatch carries out the command written by a client.
+func (cd *commandDispatcher) dispatch(value []byte) error {
+	command, err := parseCommand(string(value))
+	if err != nil {
+		return err
+	}
+	cd.mu.Lock()
+	handler, reset := cd.handlers[command], cd.reset
+	cd.mu.Unlock()
+
+	if command == CommandResetSession && reset != nil {
+		if err := reset(); err != nil {
+			return errors.WithMessage(err, "failed to reset session")
+		}
+		if handler == nil {
+			return nil
+		}
+	}
+	if handler == nil {
+		return errors.Errorf("command %s is not supported", command)
+	}
+	if err := handler(); err != nil {
+		return errors.WithMessagef(err, "command %s failed", command)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package bleperipheral
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// encryptionInfo binds derived session keys to this protocol (and its version).
+const encryptionInfo = "btprov credentials v1"
+
+// encryptionSession holds the state of an application-layer encrypted session, which is negotiated by an X25519 key
+// exchange over the public key characteristics. Credentials are then written as AES-256-GCM payloads of the form
+// nonce (12 bytes) || ciphertext || tag, authenticated with the characteristic's UUID string as additional data.
+//
+// The exchange alone is unauthenticated, so if a proof-of-possession secret is configured it is mixed into the session
+// key, which only a client holding the secret can then derive. The device key pair is replaced at the end of every
+// session, so that payloads recorded in one session cannot be replayed in another.
+type encryptionSession struct {
+	mu         *sync.Mutex
+	secret     []byte // Proof-of-possession secret, if any.
+	privateKey *ecdh.PrivateKey
+	aead       cipher.AEAD // Nil until the client has written its public key.
+
+	// publicKeyHandle is used to publish the device's public key whenever the key pair is replaced.
+	publicKeyHandle *characteristicHandle
+}
+
+func newEncryptionSession(secret []byte) (*encryptionSession, error) {
+	privateKey, err := newSessionKey()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionSession{
+		mu:              &sync.Mutex{},
+		secret:          secret,
+		privateKey:      privateKey,
+		publicKeyHandle: newCharacteristicHandle(privateKey.PublicKey().Bytes()),
+	}, nil
+}
+
+func newSessionKey() (*ecdh.PrivateKey, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to generate X25519 key pair")
+	}
+	return privateKey, nil
+}
+
+// establish derives the session key from the client's X25519 public key, replacing any previous session key.
+func (es *encryptionSession) establish(clientPublicKey []byte) error {
+	peer, err := ecdh.X25519().NewPublicKey(clientPublicKey)
+	if err != nil {
+		return errors.WithMessage(err, "invalid client public key")
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	sharedSecret, err := es.privateKey.ECDH(peer)
+	if err != nil {
+		return errors.WithMessage(err, "failed to compute shared secret")
+	}
+	salt := append(es.privateKey.PublicKey().Bytes(), clientPublicKey...)
+	salt = append(salt, es.secret...)
+	block, err := aes.NewCipher(deriveKey(sharedSecret, salt, []byte(encryptionInfo)))
+	if err != nil {
+		return errors.WithMessage(err, "failed to create AES cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.WithMessage(err, "failed to create AES-GCM cipher")
+	}
+	es.aead = aead
+	return nil
+}
+
+// reset discards the session key and replaces the device key pair, so that the next client must exchange keys again.
+func (es *encryptionSession) reset() error {
+	privateKey, err := newSessionKey()
+	if err != nil {
+		return err
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.privateKey = privateKey
+	es.aead = nil
+	if _, err := es.publicKeyHandle.Write(privateKey.PublicKey().Bytes()); err != nil {
+		return errors.WithMessage(err, "failed to publish new device public key")
+	}
+	return nil
+}
+
+// decrypt opens a payload written to the characteristic identified by additionalData.
+func (es *encryptionSession) decrypt(payload, additionalData []byte) ([]byte, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.aead == nil {
+		return nil, errors.New("no encryption session has been established")
+	}
+	if len(payload) < es.aead.NonceSize()+es.aead.Overhead() {
+		return nil, errors.Errorf("encrypted payload is too short (%d bytes)", len(payload))
+	}
+	nonce, ciphertext := payload[:es.aead.NonceSize()], payload[es.aead.NonceSize():]
+	plaintext, err := es.aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to decrypt payload")
+	}
+	return plaintext, nil
+}
+
+// deriveKey derives a 32-byte key from a shared secret as specified by HKDF-SHA256 (RFC 5869).
+func deriveKey(secret, salt, info []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)
+}
@@ -0,0 +1,125 @@
+package bleperipheral
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+// encryptAsClient encrypts plaintext the way a client does, given the device's public key and the secret, if any.
+func encryptAsClient(
+	t *testing.T, devicePublicKey, secret, plaintext, additionalData []byte,
+) (clientPublicKey, payload []byte) {
+	t.Helper()
+	clientKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(devicePublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedSecret, err := clientKey.ECDH(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := append(append(append([]byte{}, devicePublicKey...), clientKey.PublicKey().Bytes()...), secret...)
+	block, err := aes.NewCipher(deriveKey(sharedSecret, salt, []byte(encryptionInfo)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	return clientKey.PublicKey().Bytes(), aead.Seal(nonce, nonce, plaintext, additionalData)
+}
+
+func TestEncryptionSession(t *testing.T) {
+	secret := []byte("label secret")
+	ad := []byte("84d32222-13ff-42f5-bf21-be4fa89eff6f")
+	for _, tc := range []struct {
+		name         string
+		deviceSecret []byte
+		clientSecret []byte
+		ok           bool
+	}{
+		{"no secret", nil, nil, true},
+		{"matching secret", secret, secret, true},
+		{"client without secret", secret, nil, false},
+		{"wrong secret", secret, []byte("other secret"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			es, err := newEncryptionSession(tc.deviceSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			devicePublicKey := es.publicKeyHandle.currentValue()
+			clientPublicKey, payload := encryptAsClient(t, devicePublicKey, tc.clientSecret, []byte("password1"), ad)
+			if err := es.establish(clientPublicKey); err != nil {
+				t.Fatal(err)
+			}
+			plaintext, err := es.decrypt(payload, ad)
+			if !tc.ok {
+				if err == nil {
+					t.Fatal("payload encrypted without the right secret was decrypted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plaintext) != "password1" {
+				t.Fatalf("decrypted %q", plaintext)
+			}
+			if _, err := es.decrypt(payload, []byte("other characteristic")); err == nil {
+				t.Fatal("payload was decrypted with other additional data")
+			}
+		})
+	}
+}
+
+func TestEncryptionSessionReset(t *testing.T) {
+	es, err := newEncryptionSession(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := []byte("84d32222-13ff-42f5-bf21-be4fa89eff6f")
+	devicePublicKey := es.publicKeyHandle.currentValue()
+	clientPublicKey, payload := encryptAsClient(t, devicePublicKey, nil, []byte("password1"), ad)
+	if err := es.establish(clientPublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := es.reset(); err != nil {
+		t.Fatal(err)
+	}
+	newDevicePublicKey := es.publicKeyHandle.currentValue()
+	if string(newDevicePublicKey) == string(devicePublicKey) {
+		t.Fatal("device key pair was not replaced, or the new public key was not published")
+	}
+	if _, err := es.decrypt(payload, ad); err == nil {
+		t.Fatal("payload was decrypted without an established session")
+	}
+	if err := es.establish(clientPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.decrypt(payload, ad); err == nil {
+		t.Fatal("payload from the previous session was replayed")
+	}
+
+	// The published public key is the one the session is now established with.
+	clientPublicKey, payload = encryptAsClient(t, newDevicePublicKey, nil, []byte("password1"), ad)
+	if err := es.establish(clientPublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.decrypt(payload, ad); err != nil {
+		t.Fatalf("payload encrypted with the published public key was not decrypted: %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package bleperipheral
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+
+	"github.com/edaniels/golog"
+)
+
+// Names of the read-only characteristics describing the device, so that clients can tell which device they are
+// talking to beyond its advertised name.
+const (
+	HostnameCharacteristic           = "hostname"
+	WiFiMACCharacteristic            = "wifi_mac"
+	SerialNumberCharacteristic       = "serial_number"
+	OSVersionCharacteristic          = "os_version"
+	BtprovVersionCharacteristic      = "btprov_version"
+	ViamAgentInstalledCharacteristic = "viam_agent_installed"
+)
+
+const btprovModulePath = "github.com/maxhorowitz/btprov"
+
+// Version is the btprov version reported to clients. It may be set at build time with
+// -ldflags "-X github.com/maxhorowitz/btprov/ble/peripheral.Version=...", otherwise it is read from the build info.
+var Version = ""
+
+// viamAgentPaths are the files whose presence indicates that Viam agent is installed.
+var viamAgentPaths = []string{
+	"/usr/local/lib/systemd/system/viam-agent.service",
+	"/etc/systemd/system/viam-agent.service",
+	"/opt/viam/bin/viam-agent",
+}
+
+// serialNumberPaths are the files the device serial number is read from, if not given with WithSerialNumber.
+var serialNumberPaths = []string{
+	"/sys/firmware/devicetree/base/serial-number",
+	"/sys/class/dmi/id/product_serial",
+}
+
+// DeviceInfo describes the device to clients. Fields which could not be determined are left empty.
+type DeviceInfo struct {
+	Hostname           string
+	WiFiMAC            string
+	SerialNumber       string
+	OSVersion          string
+	BtprovVersion      string
+	ViamAgentInstalled bool
+}
+
+// deviceInfoCharacteristics returns the read-only characteristics exposing info.
+func deviceInfoCharacteristics(info *DeviceInfo) []characteristic {
+	readable := func(name string, component uint16, value string) characteristic {
+		char := newLinuxBLECharacteristic[string](name, component, StringCodec{}, false)
+		char.currentValue = &value
+		return char
+	}
+	viamAgentInstalled := newLinuxBLECharacteristic[bool](
+		ViamAgentInstalledCharacteristic, ViamAgentInstalledUUIDComponent, JSONCodec[bool]{}, false)
+	viamAgentInstalled.currentValue = &info.ViamAgentInstalled
+	return []characteristic{
+		readable(HostnameCharacteristic, HostnameUUIDComponent, info.Hostname),
+		readable(WiFiMACCharacteristic, WiFiMACUUIDComponent, info.WiFiMAC),
+		readable(SerialNumberCharacteristic, SerialNumberUUIDComponent, info.SerialNumber),
+		readable(OSVersionCharacteristic, OSVersionUUIDComponent, info.OSVersion),
+		readable(BtprovVersionCharacteristic, BtprovVersionUUIDComponent, info.BtprovVersion),
+		viamAgentInstalled,
+	}
+}
+
+// collectDeviceInfo gathers the device info from the host. Failures are logged and leave the field empty.
+func collectDeviceInfo(logger golog.Logger, serialNumber string) *DeviceInfo {
+	info := &DeviceInfo{
+		SerialNumber:  serialNumber,
+		BtprovVersion: btprovVersion(),
+		OSVersion:     osVersion(),
+		WiFiMAC:       wifiMAC(),
+	}
+	var err error
+	if info.Hostname, err = os.Hostname(); err != nil {
+		logger.Warnw("failed to get hostname", "err", err)
+	}
+	if info.SerialNumber == "" {
+		for _, path := range serialNumberPaths {
+			if b, err := os.ReadFile(path); err == nil {
+				info.SerialNumber = strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+				break
+			}
+		}
+	}
+	for _, path := range viamAgentPaths {
+		if _, err := os.Stat(path); err == nil {
+			info.ViamAgentInstalled = true
+			break
+		}
+	}
+	logger.Infow("collected device info", "info", info)
+	return info
+}
+
+// btprovVersion returns Version if set, or else the version of the btprov module in the build info.
+func btprovVersion() string {
+	if Version != "" {
+		return Version
+	}
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if buildInfo.Main.Path == btprovModulePath {
+		return buildInfo.Main.Version
+	}
+	for _, dep := range buildInfo.Deps {
+		if dep.Path == btprovModulePath {
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+// osVersion returns the PRETTY_NAME from /etc/os-release, e.g. "Debian GNU/Linux 12 (bookworm)".
+func osVersion() string {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// wifiMAC returns the MAC address of the first wireless network interface.
+func wifiMAC() string {
+	interfaces, err := filepath.Glob("/sys/class/net/*/wireless")
+	if err != nil || len(interfaces) == 0 {
+		return ""
+	}
+	b, err := os.ReadFile(filepath.Join(filepath.Dir(interfaces[0]), "address"))
+	if err != nil {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSpace(string(b)))
+}
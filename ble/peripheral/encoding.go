@@ -0,0 +1,192 @@
+package bleperipheral
+
+import (
+	"math"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Encoding is how the networks list, status and write rejection payloads are encoded. Clients choose one through the
+// encoding handshake: they read the encoding characteristic, holding the current encoding followed by every supported
+// one (a byte each), and write the encoding they want to the encoding selection characteristic. Until they do, and once
+// every central disconnects, payloads are JSON.
+type Encoding byte
+
+const (
+	EncodingJSON Encoding = 0x00
+	// EncodingProtobuf encodes payloads as the protobuf messages documented in the README, which are a fraction of the
+	// size of their JSON counterparts.
+	EncodingProtobuf Encoding = 0x01
+)
+
+// supportedEncodings lists the encodings clients may select, in order of preference.
+var supportedEncodings = []Encoding{EncodingJSON, EncodingProtobuf}
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingJSON:
+		return "json"
+	case EncodingProtobuf:
+		return "protobuf"
+	default:
+		return "unknown"
+	}
+}
+
+// payload is a value published to clients in the negotiated encoding.
+type payload interface {
+	ToBytes() ([]byte, error) // As JSON.
+	toProto() []byte
+}
+
+// encode encodes p in encoding e.
+func (e Encoding) encode(p payload) ([]byte, error) {
+	if e == EncodingProtobuf {
+		return p.toProto(), nil
+	}
+	return p.ToBytes()
+}
+
+// encodingNegotiator implements the encoding handshake, re-encoding every payload already published once a client
+// selects a new encoding.
+type encodingNegotiator struct {
+	mu        *sync.Mutex
+	current   Encoding
+	handle    *characteristicHandle
+	reencoded []func(Encoding) error // Re-publish a payload in the given encoding.
+}
+
+func newEncodingNegotiator(reencoded ...func(Encoding) error) *encodingNegotiator {
+	en := &encodingNegotiator{mu: &sync.Mutex{}, current: EncodingJSON, reencoded: reencoded}
+	en.handle = newCharacteristicHandle(en.valueLocked())
+	return en
+}
+
+// valueLocked returns the value of the encoding characteristic: the current encoding, then the supported encodings.
+func (en *encodingNegotiator) valueLocked() []byte {
+	value := []byte{byte(en.current)}
+	for _, encoding := range supportedEncodings {
+		value = append(value, byte(encoding))
+	}
+	return value
+}
+
+// selectEncoding handles a write to the encoding selection characteristic, which holds a single encoding.
+func (en *encodingNegotiator) selectEncoding(value []byte) error {
+	if len(value) != 1 {
+		return errors.Errorf("encoding selection must be 1 byte, got %d", len(value))
+	}
+	return en.use(Encoding(value[0]))
+}
+
+// use switches to the given encoding and re-publishes every payload in it.
+func (en *encodingNegotiator) use(encoding Encoding) error {
+	supported := false
+	for _, e := range supportedEncodings {
+		if e == encoding {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return errors.Errorf("unsupported encoding %#02x", byte(encoding))
+	}
+
+	en.mu.Lock()
+	defer en.mu.Unlock()
+	if encoding == en.current {
+		return nil
+	}
+	en.current = encoding
+	if _, err := en.handle.Write(en.valueLocked()); err != nil {
+		return errors.WithMessage(err, "failed to write encoding to bluetooth characteristic")
+	}
+	for _, reencode := range en.reencoded {
+		if err := reencode(encoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Field numbers and enum values of the protobuf messages, see the README for their definitions.
+var (
+	protoSecurities = map[WiFiSecurity]uint64{
+		SecurityOpen: 1, SecurityWEP: 2, SecurityWPA2: 3, SecurityWPA3: 4, SecurityEnterprise: 5,
+	}
+	protoBands  = map[WiFiBand]uint64{Band2_4GHz: 1, Band5GHz: 2, Band6GHz: 3}
+	protoStates = map[ProvisioningState]uint64{
+		StateWaiting: 0, StateCredentialsReceived: 1, StateScanning: 2, StateConnecting: 3, StateConnected: 4,
+		StateFailed: 5,
+	}
+)
+
+func (n *WiFiNetwork) appendProto(b []byte) []byte {
+	b = appendProtoString(b, 1, n.Ssid)
+	if n.Strength != 0 {
+		b = protowire.AppendTag(b, 2, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(float32(n.Strength)))
+	}
+	b = appendProtoBool(b, 3, n.RequiresPsk)
+	b = appendProtoVarint(b, 4, protoSecurities[n.Security])
+	b = appendProtoVarint(b, 5, uint64(n.FrequencyMHz))
+	b = appendProtoVarint(b, 6, protoBands[n.Band])
+	b = appendProtoVarint(b, 7, uint64(n.Channel))
+	b = appendProtoVarint(b, 8, uint64(n.BSSIDCount))
+	b = appendProtoVarint(b, 9, protowire.EncodeZigZag(int64(n.RSSI)))
+	return appendProtoBool(b, 10, n.Saved)
+}
+
+func (awnp *AvailableWiFiNetworksPage) toProto() []byte {
+	var b []byte
+	for _, network := range awnp.Networks {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, network.appendProto(nil))
+	}
+	b = appendProtoVarint(b, 2, uint64(awnp.Page))
+	b = protowire.AppendTag(b, 3, protowire.VarintType) // Always present, see toProto.
+	return protowire.AppendVarint(b, uint64(awnp.PageCount))
+}
+
+// toProto always includes the state, even StateWaiting. Messages must never be empty, as BlueZ (through tinygo) ignores
+// empty values, which would leave clients with the previous status.
+func (ps *ProvisioningStatus) toProto() []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, protoStates[ps.State])
+	return appendProtoString(b, 2, ps.Reason)
+}
+
+// toProto always includes the characteristic, even when empty because there is no rejection, see
+// ProvisioningStatus.toProto.
+func (wr *WriteRejection) toProto() []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	b = protowire.AppendString(b, wr.Characteristic)
+	return appendProtoString(b, 2, wr.Reason)
+}
+
+// The following append a field unless it holds the zero value, which protobuf leaves out.
+
+func appendProtoString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendProtoBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoVarint(b, num, 1)
+}
@@ -0,0 +1,105 @@
+package bleperipheral
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestEncodingNeverEmpty(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload payload
+	}{
+		{"waiting status", &ProvisioningStatus{State: StateWaiting}},
+		{"failed status", &ProvisioningStatus{State: StateFailed, Reason: "wrong psk"}},
+		{"cleared rejection", &WriteRejection{}},
+		{"rejection", &WriteRejection{Characteristic: "ssid", Reason: "too long"}},
+		{"empty page", &AvailableWiFiNetworksPage{PageCount: 1}},
+	} {
+		for _, encoding := range supportedEncodings {
+			bs, err := encoding.encode(tc.payload)
+			if err != nil {
+				t.Fatalf("%s as %s: %v", tc.name, encoding, err)
+			}
+			if len(bs) == 0 {
+				t.Errorf("%s as %s is empty", tc.name, encoding)
+			}
+		}
+	}
+}
+
+func TestProvisioningStatusToProto(t *testing.T) {
+	for _, tc := range []struct {
+		status ProvisioningStatus
+		want   []byte
+	}{
+		{ProvisioningStatus{State: StateWaiting}, []byte{0x08, 0x00}},
+		{ProvisioningStatus{State: StateConnected}, []byte{0x08, 0x04}},
+		{ProvisioningStatus{State: StateFailed, Reason: "no"}, []byte{0x08, 0x05, 0x12, 0x02, 'n', 'o'}},
+	} {
+		if got := tc.status.toProto(); !bytes.Equal(got, tc.want) {
+			t.Errorf("%+v encoded as % x, want % x", tc.status, got, tc.want)
+		}
+	}
+}
+
+func TestWriteRejectionToProto(t *testing.T) {
+	if got, want := (&WriteRejection{}).toProto(), []byte{0x0a, 0x00}; !bytes.Equal(got, want) {
+		t.Errorf("cleared rejection encoded as % x, want % x", got, want)
+	}
+
+	b := (&WriteRejection{Characteristic: "psk", Reason: "too short"}).toProto()
+	fields := map[protowire.Number]string{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || typ != protowire.BytesType {
+			t.Fatalf("malformed field: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeString(b)
+		if n < 0 {
+			t.Fatalf("malformed string: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		fields[num] = v
+	}
+	if fields[1] != "psk" || fields[2] != "too short" {
+		t.Errorf("decoded fields %q", fields)
+	}
+}
+
+func TestEncodingNegotiator(t *testing.T) {
+	var reencoded []Encoding
+	en := newEncodingNegotiator(func(e Encoding) error {
+		reencoded = append(reencoded, e)
+		return nil
+	})
+	if got, want := en.handle.currentValue(), []byte{0x00, 0x00, 0x01}; !bytes.Equal(got, want) {
+		t.Fatalf("encoding characteristic holds % x, want % x", got, want)
+	}
+
+	for _, tc := range []struct {
+		value []byte
+		ok    bool
+	}{
+		{[]byte{0x01}, true},
+		{[]byte{0x01}, true}, // Already selected, so nothing is re-encoded.
+		{[]byte{0x02}, false},
+		{[]byte{0x00, 0x01}, false},
+		{nil, false},
+		{[]byte{0x00}, true},
+	} {
+		if err := en.selectEncoding(tc.value); (err == nil) != tc.ok {
+			t.Errorf("selectEncoding(% x) = %v, want ok %t", tc.value, err, tc.ok)
+		}
+	}
+	if want := []Encoding{EncodingProtobuf, EncodingJSON}; len(reencoded) != 2 ||
+		reencoded[0] != want[0] || reencoded[1] != want[1] {
+		t.Errorf("re-encoded as %v, want %v", reencoded, want)
+	}
+	if got, want := en.handle.currentValue(), []byte{0x00, 0x00, 0x01}; !bytes.Equal(got, want) {
+		t.Errorf("encoding characteristic holds % x, want % x", got, want)
+	}
+}
@@ -0,0 +1,213 @@
+package bleperipheral
+
+import (
+	"context"
+	"sync"
+
+	"github.com/edaniels/golog"
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+// MemoryBLEPeripheral is a BLEPeripheral which keeps its GATT service in memory instead of registering it with BlueZ.
+// It runs the same provisioning protocol as the Linux peripheral, and lets tests and simulations play the part of
+// clients by connecting, disconnecting, writing and reading characteristics deterministically.
+type MemoryBLEPeripheral struct {
+	*provisioningService
+	mu *sync.Mutex
+
+	advertising bool
+	gattValues  map[bluetooth.UUID]*memoryCharacteristic
+	connected   map[string]struct{}
+}
+
+// memoryCharacteristic stores the value of a characteristic in place of a GATT server.
+type memoryCharacteristic struct {
+	gattCharacteristic
+	mu    *sync.Mutex
+	value []byte
+}
+
+func (mc *memoryCharacteristic) Write(p []byte) (int, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.value = append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (mc *memoryCharacteristic) read() []byte {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.value
+}
+
+// NewMemoryBLEPeripheral returns an in-memory BLE peripheral, configured by the same options as NewLinuxBLEPeripheral.
+func NewMemoryBLEPeripheral(ctx context.Context, logger golog.Logger, opts ...Option) (*MemoryBLEPeripheral, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	ps, err := newProvisioningService(ctx, logger, o)
+	if err != nil {
+		return nil, err
+	}
+
+	gattValues := map[bluetooth.UUID]*memoryCharacteristic{}
+	for _, gattChar := range ps.gattChars {
+		mc := &memoryCharacteristic{gattCharacteristic: gattChar, mu: &sync.Mutex{}}
+		if gattChar.handle != nil {
+			if err := gattChar.handle.bind(mc); err != nil {
+				return nil, err
+			}
+		}
+		gattValues[gattChar.UUID] = mc
+	}
+	m := &MemoryBLEPeripheral{
+		provisioningService: ps,
+		mu:                  &sync.Mutex{},
+		gattValues:          gattValues,
+		connected:           map[string]struct{}{},
+	}
+	ps.limiter.setDisconnect(m.SimulateDisconnect)
+	ps.commands.setReset(func() error {
+		return ps.resetSession(ps.UpdateStatus)
+	})
+	return m, nil
+}
+
+func (m *MemoryBLEPeripheral) StartAdvertising(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.advertising {
+		return errors.New("invalid request, advertising already active")
+	}
+	m.advertising = true
+	m.window.open(func() {
+		if err := m.StopAdvertising(); err != nil {
+			m.logger.Warnw("failed to stop advertising at the end of the advertising window", "err", err)
+		}
+	})
+	return nil
+}
+
+func (m *MemoryBLEPeripheral) StopAdvertising() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.advertising {
+		return errors.New("invalid request, advertising already inactive")
+	}
+	m.advertising = false
+	m.window.close()
+	return m.resetAuthentication()
+}
+
+// IsAdvertising returns whether the peripheral is advertising, i.e. whether centrals can connect.
+func (m *MemoryBLEPeripheral) IsAdvertising() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.advertising
+}
+
+// SimulateConnect connects a central with the given address, which requires the peripheral to be advertising and the
+// central not to be locked out (see WithRateLimitPolicy).
+func (m *MemoryBLEPeripheral) SimulateConnect(address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.advertising {
+		return errors.Errorf("central %s cannot connect, peripheral is not advertising", address)
+	}
+	if err := m.limiter.checkLockout(address); err != nil {
+		return err
+	}
+	if _, ok := m.connected[address]; ok {
+		return errors.Errorf("central %s is already connected", address)
+	}
+	m.connected[address] = struct{}{}
+	m.centrals.connected(address)
+	return nil
+}
+
+// SimulateDisconnect disconnects the central with the given address.
+func (m *MemoryBLEPeripheral) SimulateDisconnect(address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.connected[address]; !ok {
+		return errors.Errorf("central %s is not connected", address)
+	}
+	delete(m.connected, address)
+	m.centrals.disconnected(address)
+	return nil
+}
+
+// SimulatePair pairs the connected central with the given address.
+func (m *MemoryBLEPeripheral) SimulatePair(address string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.connected[address]; !ok {
+		return errors.Errorf("central %s is not connected", address)
+	}
+	m.centrals.paired(address)
+	return nil
+}
+
+// SimulateMTUExchange records the ATT MTU negotiated with the connected central with the given address.
+func (m *MemoryBLEPeripheral) SimulateMTUExchange(address string, mtu int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.connected[address]; !ok {
+		return errors.Errorf("central %s is not connected", address)
+	}
+	m.centrals.setMTU(address, mtu)
+	return nil
+}
+
+// SimulateWrite writes a value (or a fragment of one, at the given offset) from a connected central to the
+// characteristic identified by its UUID component. Values are committed once the commit delay passes, or on FlushWrites.
+func (m *MemoryBLEPeripheral) SimulateWrite(address string, component uint16, offset int, value []byte) error {
+	mc, err := m.connectedCharacteristic(address, component)
+	if err != nil {
+		return err
+	}
+	if !mc.Flags.Write() || mc.WriteEvent == nil {
+		return errors.Errorf("characteristic %#04x is not writable", component)
+	}
+	mc.WriteEvent(bluetooth.Connection(0), offset, value)
+	return nil
+}
+
+// SimulateRead reads the value of the characteristic identified by its UUID component as a connected central.
+func (m *MemoryBLEPeripheral) SimulateRead(address string, component uint16) ([]byte, error) {
+	mc, err := m.connectedCharacteristic(address, component)
+	if err != nil {
+		return nil, err
+	}
+	if !mc.Flags.Read() {
+		return nil, errors.Errorf("characteristic %#04x is not readable", component)
+	}
+	return mc.read(), nil
+}
+
+// FlushWrites commits all values written so far immediately, rather than waiting for the commit delay to pass.
+func (m *MemoryBLEPeripheral) FlushWrites() {
+	m.wp.flush()
+}
+
+func (m *MemoryBLEPeripheral) connectedCharacteristic(address string, component uint16) (*memoryCharacteristic, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.connected[address]; !ok {
+		return nil, errors.Errorf("central %s is not connected", address)
+	}
+	mc, ok := m.gattValues[DeriveUUID(m.baseUUID, component)]
+	if !ok {
+		return nil, errors.Errorf("no characteristic with UUID component %#04x", component)
+	}
+	return mc, nil
+}
@@ -0,0 +1,187 @@
+package bleperipheral
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Option configures optional behavior of a BLE peripheral at construction time.
+type Option func(*options)
+
+type options struct {
+	baseUUID           uuid.UUID
+	serialNumber       string
+	adapterID          string
+	adapterAddress     string
+	localAddress       string // Of the adapter in use, set by NewLinuxBLEPeripheral.
+	encryptCredentials bool
+	popSecret          []byte
+	popSecretFile      string
+	agentCapability    AgentCapability
+	pairingHandler     *PairingHandler
+	trustPolicy        TrustPolicy
+	rateLimitPolicy    *RateLimitPolicy
+
+	manufacturerCompanyID uint16
+	advertisedDeviceID    []byte
+
+	advertisingTimeout time.Duration
+	powerOffOnTimeout  bool
+
+	longWriteCommitDelay time.Duration
+	networksPageSize     int
+
+	characteristics []characteristic
+	deviceInfo      *DeviceInfo
+}
+
+func defaultOptions() *options {
+	return &options{
+		baseUUID:        DefaultBaseUUID,
+		adapterID:       defaultAdapterID,
+		agentCapability: CapabilityNoInputNoOutput,
+
+		manufacturerCompanyID: DefaultManufacturerCompanyID,
+		longWriteCommitDelay:  defaultLongWriteCommitDelay,
+		networksPageSize:      defaultNetworksPageSize,
+	}
+}
+
+// WithBaseUUID derives all GATT UUIDs from the given base rather than DefaultBaseUUID.
+func WithBaseUUID(base uuid.UUID) Option {
+	return func(o *options) {
+		o.baseUUID = base
+	}
+}
+
+// WithSerialNumber derives all GATT UUIDs from a base unique to the given device serial number (see BaseUUIDFromSerial).
+func WithSerialNumber(serial string) Option {
+	return func(o *options) {
+		o.baseUUID = BaseUUIDFromSerial(serial)
+		o.serialNumber = serial
+	}
+}
+
+// WithAdapterID selects the bluetooth adapter to advertise on by its BlueZ ID (e.g. hci1) instead of hci0.
+func WithAdapterID(id string) Option {
+	return func(o *options) {
+		o.adapterID = id
+	}
+}
+
+// WithAdapterAddress selects the bluetooth adapter to advertise on by its MAC address (e.g. 00:1A:7D:DA:71:13).
+func WithAdapterAddress(address string) Option {
+	return func(o *options) {
+		o.adapterAddress = address
+	}
+}
+
+// WithEncryptedCredentials requires credentials to be written as AES-GCM payloads encrypted with a session key negotiated
+// over the key exchange characteristics, so that they remain confidential even with "Just Works" pairing.
+func WithEncryptedCredentials() Option {
+	return func(o *options) {
+		o.encryptCredentials = true
+	}
+}
+
+// WithProofOfPossession requires clients to prove knowledge of secret (e.g. printed on the device label) through a
+// challenge/response over the proof-of-possession characteristics before any credential writes are accepted.
+func WithProofOfPossession(secret []byte) Option {
+	return func(o *options) {
+		o.popSecret = secret
+	}
+}
+
+// WithProofOfPossessionFile is like WithProofOfPossession, but reads the secret from a file when the peripheral is created.
+func WithProofOfPossessionFile(path string) Option {
+	return func(o *options) {
+		o.popSecretFile = path
+	}
+}
+
+// WithLongWriteCommitDelay sets how long a value written in fragments may go without a new fragment before it is
+// considered complete and committed.
+func WithLongWriteCommitDelay(delay time.Duration) Option {
+	return func(o *options) {
+		o.longWriteCommitDelay = delay
+	}
+}
+
+// WithNetworksPageSize sets the maximum size in bytes of each page of available WiFi networks. Pages should fit in a
+// single ATT read, i.e. be no larger than the smallest MTU clients are expected to negotiate, minus one.
+func WithNetworksPageSize(size int) Option {
+	return func(o *options) {
+		o.networksPageSize = size
+	}
+}
+
+// WithAgentCapability sets the IO capability the pairing agent registers with BlueZ, which determines how pairing is
+// authenticated. The default, CapabilityNoInputNoOutput, pairs with "Just Works".
+func WithAgentCapability(capability AgentCapability) Option {
+	return func(o *options) {
+		o.agentCapability = capability
+	}
+}
+
+// WithPairingHandler registers callbacks through which the host application displays or verifies pairing codes.
+func WithPairingHandler(handler *PairingHandler) Option {
+	return func(o *options) {
+		o.pairingHandler = handler
+	}
+}
+
+// WithTrustPolicy sets which centrals are trusted by BlueZ when they connect. By default, every central is trusted for
+// the provisioning session only.
+func WithTrustPolicy(policy TrustPolicy) Option {
+	return func(o *options) {
+		o.trustPolicy = policy
+	}
+}
+
+// WithRateLimitPolicy limits how often centrals may write, and locks out centrals which repeatedly fail proof of
+// possession or Wi-Fi connection attempts. By default, neither is limited.
+func WithRateLimitPolicy(policy *RateLimitPolicy) Option {
+	return func(o *options) {
+		o.rateLimitPolicy = policy
+	}
+}
+
+// WithManufacturerCompanyID sets the Bluetooth SIG assigned company ID that manufacturer data is advertised under.
+func WithManufacturerCompanyID(companyID uint16) Option {
+	return func(o *options) {
+		o.manufacturerCompanyID = companyID
+	}
+}
+
+// WithAdvertisedDeviceID sets the device ID (at most 4 bytes) announced in the manufacturer data of advertisements. By
+// default, the first 4 bytes of the base UUID derived from the device serial number are used (see WithSerialNumber),
+// or, if the serial number is not known, the last 4 bytes of the bluetooth adapter address.
+func WithAdvertisedDeviceID(id []byte) Option {
+	return func(o *options) {
+		o.advertisedDeviceID = id
+	}
+}
+
+// WithAdvertisingTimeout stops advertising once the given duration has passed since it started, rather than
+// advertising until stopped. See BLEPeripheral.AdvertisingTimeout.
+func WithAdvertisingTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.advertisingTimeout = timeout
+	}
+}
+
+// WithPowerOffOnTimeout also powers the bluetooth adapter off when the advertising window set with
+// WithAdvertisingTimeout elapses. It is powered on again when advertising restarts.
+func WithPowerOffOnTimeout() Option {
+	return func(o *options) {
+		o.powerOffOnTimeout = true
+	}
+}
+
+// WithDeviceInfo sets the device info exposed to clients, rather than collecting it from the host.
+func WithDeviceInfo(info *DeviceInfo) Option {
+	return func(o *options) {
+		o.deviceInfo = info
+	}
+}
@@ -0,0 +1,234 @@
+package bleperipheral
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/edaniels/golog"
+	"github.com/pkg/errors"
+	"go.viam.com/utils"
+)
+
+// defaultNetworksPageSize is the maximum size of a page of available WiFi networks in bytes. It fits in a single ATT
+// read at an MTU of 185, the MTU most commonly negotiated by mobile clients.
+const defaultNetworksPageSize = 180
+
+// AvailableWiFiNetworksPage is a page of available WiFi networks, which is what the available WiFi networks
+// characteristic holds. Clients select a page by writing its index to the page index characteristic.
+type AvailableWiFiNetworksPage struct {
+	AvailableWiFiNetworks
+	Page      int `json:"page"`
+	PageCount int `json:"page_count"`
+}
+
+func (awnp *AvailableWiFiNetworksPage) ToBytes() ([]byte, error) {
+	return json.Marshal(awnp)
+}
+
+// paginate splits the networks into pages of at most pageSize bytes each in the given encoding. A network too large to
+// fit a page on its own (e.g. one with a 32 byte SSID and every detail known, in JSON at the default page size) is
+// reduced to its SSID, strength and whether it requires a PSK. If it is still too large, it is given a page of its own,
+// even if that page exceeds pageSize.
+func paginate(awns *AvailableWiFiNetworks, pageSize int, encoding Encoding) ([][]byte, error) {
+	networks := make([]*WiFiNetwork, len(awns.Networks))
+	for i, network := range awns.Networks {
+		// The page numbers are not known yet, but cannot exceed the network count, so this errs on the side of caution.
+		alone := &AvailableWiFiNetworksPage{Page: len(networks), PageCount: len(networks)}
+		alone.Networks = []*WiFiNetwork{network}
+		bs, err := encoding.encode(alone)
+		if err != nil {
+			return nil, err
+		}
+		networks[i] = network
+		if len(bs) > pageSize {
+			networks[i] = network.essentials()
+		}
+	}
+
+	var pages []*AvailableWiFiNetworksPage
+	start := 0
+	for end := 1; end <= len(networks); end++ {
+		// The page count is not known yet, but cannot exceed the network count, so this errs on the side of caution.
+		candidate := &AvailableWiFiNetworksPage{Page: len(pages), PageCount: len(networks)}
+		candidate.Networks = networks[start:end]
+		bs, err := encoding.encode(candidate)
+		if err != nil {
+			return nil, err
+		}
+		if len(bs) > pageSize && end-start > 1 {
+			page := &AvailableWiFiNetworksPage{}
+			page.Networks = networks[start : end-1]
+			pages = append(pages, page)
+			start = end - 1
+		}
+	}
+	last := &AvailableWiFiNetworksPage{}
+	last.Networks = networks[start:]
+	pages = append(pages, last)
+
+	encoded := make([][]byte, 0, len(pages))
+	for i, page := range pages {
+		page.Page = i
+		page.PageCount = len(pages)
+		bs, err := encoding.encode(page)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, bs)
+	}
+	return encoded, nil
+}
+
+// networksPager serves the available WiFi networks one page at a time through the characteristic handle.
+type networksPager struct {
+	mu       *sync.Mutex
+	pageSize int
+	networks *AvailableWiFiNetworks
+	encoding Encoding
+	pages    [][]byte
+	index    int
+	handle   *characteristicHandle
+}
+
+func newNetworksPager(pageSize int) (*networksPager, error) {
+	networks := &AvailableWiFiNetworks{}
+	pages, err := paginate(networks, pageSize, EncodingJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &networksPager{
+		mu:       &sync.Mutex{},
+		pageSize: pageSize,
+		networks: networks,
+		encoding: EncodingJSON,
+		pages:    pages,
+		handle:   newCharacteristicHandle(pages[0]),
+	}, nil
+}
+
+// update replaces the networks being served. The selected page is kept if it still exists.
+func (np *networksPager) update(awns *AvailableWiFiNetworks) error {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	return np.paginateLocked(awns, np.encoding)
+}
+
+// setEncoding serves the networks in the given encoding. The selected page is kept if it still exists.
+func (np *networksPager) setEncoding(encoding Encoding) error {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	return np.paginateLocked(np.networks, encoding)
+}
+
+func (np *networksPager) paginateLocked(awns *AvailableWiFiNetworks, encoding Encoding) error {
+	pages, err := paginate(awns, np.pageSize, encoding)
+	if err != nil {
+		return errors.WithMessage(err, "failed to cast available WiFi networks to bytes")
+	}
+	np.networks = awns
+	np.encoding = encoding
+	np.pages = pages
+	if np.index >= len(pages) {
+		np.index = 0
+	}
+	return np.publish()
+}
+
+// selectPage serves the page with the given index, which is encoded as a little-endian uint8 or uint16.
+func (np *networksPager) selectPage(value []byte) error {
+	var index int
+	switch len(value) {
+	case 1:
+		index = int(value[0])
+	case 2:
+		index = int(binary.LittleEndian.Uint16(value))
+	default:
+		return errors.Errorf("page index must be 1 or 2 bytes, got %d", len(value))
+	}
+
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	if index >= len(np.pages) {
+		return errors.Errorf("page index %d out of range, there are %d pages", index, len(np.pages))
+	}
+	np.index = index
+	return np.publish()
+}
+
+// publish must be called with the lock held.
+func (np *networksPager) publish() error {
+	if _, err := np.handle.Write(np.pages[np.index]); err != nil {
+		return errors.WithMessage(err, "failed to write available WiFi networks to bluetooth characteristic")
+	}
+	return nil
+}
+
+// networksUpdater publishes updates of the available WiFi networks in the background, so that callers never wait on
+// the GATT server. Updates arriving while another is being published are coalesced, and only the latest is published.
+type networksUpdater struct {
+	logger golog.Logger
+	pager  *networksPager
+	done   <-chan struct{}
+
+	mu      *sync.Mutex
+	latest  *AvailableWiFiNetworks
+	pending chan struct{} // Holds a token while latest is waiting to be published.
+}
+
+// startNetworksUpdater publishes updates through pager until ctx is done.
+func startNetworksUpdater(ctx context.Context, logger golog.Logger, pager *networksPager) *networksUpdater {
+	nu := &networksUpdater{
+		logger:  logger,
+		pager:   pager,
+		done:    ctx.Done(),
+		mu:      &sync.Mutex{},
+		pending: make(chan struct{}, 1),
+	}
+	utils.ManagedGo(nu.run, nil)
+	return nu
+}
+
+// update replaces any update not yet published with awns.
+func (nu *networksUpdater) update(awns *AvailableWiFiNetworks) error {
+	if awns == nil {
+		return errors.New("available WiFi networks must not be nil")
+	}
+	select {
+	case <-nu.done:
+		return errors.New("cannot update available WiFi networks, the peripheral has shut down")
+	default:
+	}
+
+	nu.mu.Lock()
+	nu.latest = awns
+	nu.mu.Unlock()
+	select {
+	case nu.pending <- struct{}{}:
+	default: // The update already pending will pick up latest.
+	}
+	return nil
+}
+
+func (nu *networksUpdater) run() {
+	for {
+		select {
+		case <-nu.done:
+			return
+		case <-nu.pending:
+		}
+		nu.mu.Lock()
+		awns := nu.latest
+		nu.latest = nil
+		nu.mu.Unlock()
+		if awns == nil {
+			continue
+		}
+		if err := nu.pager.update(awns); err != nil {
+			nu.logger.Errorw("failed to update available WiFi networks on bluetooth characteristic", "err", err)
+			continue
+		}
+		nu.logger.Infow("successfully updated available WiFi networks on bluetooth characteristic")
+	}
+}
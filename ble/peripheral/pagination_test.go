@@ -0,0 +1,179 @@
+package bleperipheral
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// worstCaseNetwork returns a network with the longest SSID and every detail known, at their longest.
+func worstCaseNetwork() *WiFiNetwork {
+	return &WiFiNetwork{
+		Ssid:         strings.Repeat("w", 32),
+		Strength:     0.67, // Strengths are whole percentages.
+		RequiresPsk:  true,
+		Security:     SecurityEnterprise,
+		FrequencyMHz: 5885,
+		Band:         Band2_4GHz,
+		Channel:      177,
+		BSSIDCount:   999,
+		RSSI:         -100,
+		Saved:        true,
+	}
+}
+
+func TestPaginateWorstCaseNetwork(t *testing.T) {
+	worst := worstCaseNetwork()
+	short := worstCaseNetwork()
+	short.Ssid = "home"
+	short.BSSIDCount = 3
+	awns := &AvailableWiFiNetworks{Networks: []*WiFiNetwork{worst, short, worst}}
+
+	for _, encoding := range supportedEncodings {
+		pages, err := paginate(awns, defaultNetworksPageSize, encoding)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		for i, page := range pages {
+			if len(page) > defaultNetworksPageSize {
+				t.Errorf("%s: page %d is %d bytes, more than %d", encoding, i, len(page), defaultNetworksPageSize)
+			}
+		}
+		if encoding != EncodingJSON {
+			continue
+		}
+
+		var networks []*WiFiNetwork
+		for _, page := range pages {
+			var decoded AvailableWiFiNetworksPage
+			if err := json.Unmarshal(page, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			networks = append(networks, decoded.Networks...)
+		}
+		if len(networks) != 3 {
+			t.Fatalf("paginated %d networks, want 3", len(networks))
+		}
+		if *networks[0] != *worst.essentials() || *networks[2] != *worst.essentials() {
+			t.Errorf("worst case network paginated as %+v, want %+v", networks[0], worst.essentials())
+		}
+		// The band and channel are left out of JSON.
+		want := *short
+		want.Band, want.Channel = "", 0
+		if *networks[1] != want {
+			t.Errorf("network which fits paginated as %+v, want %+v", networks[1], want)
+		}
+	}
+	if *awns.Networks[0] != *worstCaseNetwork() {
+		t.Error("paginate modified the networks")
+	}
+}
+
+func testNetworks(n int) *AvailableWiFiNetworks {
+	awns := &AvailableWiFiNetworks{}
+	for i := 0; i < n; i++ {
+		awns.Networks = append(awns.Networks, &WiFiNetwork{
+			Ssid: "network-" + strings.Repeat("x", i%10), Strength: 0.5, RequiresPsk: i%2 == 0,
+		})
+	}
+	return awns
+}
+
+func TestPaginate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		networks int
+		pageSize int
+		pages    int // Zero if it depends on the encoding, in which case there must be several.
+	}{
+		{"no networks", 0, defaultNetworksPageSize, 1},
+		{"one network", 1, defaultNetworksPageSize, 1},
+		{"several pages", 30, defaultNetworksPageSize, 0},
+		{"page per network", 5, 1, 5},
+	} {
+		for _, encoding := range supportedEncodings {
+			t.Run(tc.name+" as "+encoding.String(), func(t *testing.T) {
+				awns := testNetworks(tc.networks)
+				pages, err := paginate(awns, tc.pageSize, encoding)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.pages > 0 && len(pages) != tc.pages {
+					t.Fatalf("paginated into %d pages, want %d", len(pages), tc.pages)
+				}
+				if tc.pages == 0 && len(pages) < 2 {
+					t.Fatalf("paginated into %d pages, want several", len(pages))
+				}
+				for i, page := range pages {
+					if len(page) > tc.pageSize && tc.pageSize >= defaultNetworksPageSize {
+						t.Errorf("page %d is %d bytes, more than %d", i, len(page), tc.pageSize)
+					}
+				}
+				if encoding != EncodingJSON {
+					return
+				}
+
+				var ssids []string
+				for i, page := range pages {
+					var decoded AvailableWiFiNetworksPage
+					if err := json.Unmarshal(page, &decoded); err != nil {
+						t.Fatal(err)
+					}
+					if decoded.Page != i || decoded.PageCount != len(pages) {
+						t.Errorf("page %d is numbered %d of %d", i, decoded.Page, decoded.PageCount)
+					}
+					for _, network := range decoded.Networks {
+						ssids = append(ssids, network.Ssid)
+					}
+				}
+				if len(ssids) != len(awns.Networks) {
+					t.Fatalf("paginated %d networks, want %d", len(ssids), len(awns.Networks))
+				}
+				for i, network := range awns.Networks {
+					if ssids[i] != network.Ssid {
+						t.Errorf("network %d is %q, want %q", i, ssids[i], network.Ssid)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestNetworksPagerSelectPage(t *testing.T) {
+	np, err := newNetworksPager(defaultNetworksPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := np.update(testNetworks(30)); err != nil {
+		t.Fatal(err)
+	}
+	pageCount := len(np.pages)
+	for _, tc := range []struct {
+		value []byte
+		index int // Of the page served afterwards.
+		ok    bool
+	}{
+		{[]byte{1}, 1, true},
+		{[]byte{0, 0}, 0, true},
+		{[]byte{byte(pageCount - 1), 0}, pageCount - 1, true},
+		{[]byte{byte(pageCount)}, pageCount - 1, false},
+		{[]byte{0, 1}, pageCount - 1, false},
+		{[]byte{0, 0, 0}, pageCount - 1, false},
+		{nil, pageCount - 1, false},
+	} {
+		if err := np.selectPage(tc.value); (err == nil) != tc.ok {
+			t.Errorf("selectPage(% x) = %v, want ok %t", tc.value, err, tc.ok)
+		}
+		if got := np.handle.currentValue(); string(got) != string(np.pages[tc.index]) {
+			t.Errorf("after selectPage(% x), serving %s, want page %d", tc.value, got, tc.index)
+		}
+	}
+
+	// The selected page is kept while it still exists.
+	if err := np.update(testNetworks(1)); err != nil {
+		t.Fatal(err)
+	}
+	if np.index != 0 {
+		t.Errorf("serving page %d of %d", np.index, len(np.pages))
+	}
+}
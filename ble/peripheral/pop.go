@@ -0,0 +1,108 @@
+package bleperipheral
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const popChallengeLength = 16
+
+// proofOfPossession gates credential writes behind a challenge/response over a secret held by the device (e.g. printed
+// on its label). The client reads a random challenge and writes back HMAC-SHA256(secret, challenge); the challenge is
+// replaced after every attempt, so responses cannot be replayed.
+type proofOfPossession struct {
+	mu *sync.Mutex
+
+	secret    []byte
+	challenge []byte
+	verified  bool
+
+	// challengeHandle is used to publish a new challenge after each attempt.
+	challengeHandle *characteristicHandle
+}
+
+func newProofOfPossession(secret []byte) (*proofOfPossession, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("proof-of-possession secret is empty")
+	}
+	challenge, err := newPoPChallenge()
+	if err != nil {
+		return nil, err
+	}
+	return &proofOfPossession{
+		mu:              &sync.Mutex{},
+		secret:          secret,
+		challenge:       challenge,
+		challengeHandle: newCharacteristicHandle(challenge),
+	}, nil
+}
+
+// readPoPSecretFile reads a proof-of-possession secret from a file, ignoring surrounding whitespace.
+func readPoPSecretFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to read proof-of-possession secret from %s", path)
+	}
+	return bytes.TrimSpace(b), nil
+}
+
+func newPoPChallenge() ([]byte, error) {
+	challenge := make([]byte, popChallengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, errors.WithMessage(err, "failed to generate proof-of-possession challenge")
+	}
+	return challenge, nil
+}
+
+// verify checks a client's response to the current challenge and rotates the challenge.
+func (pop *proofOfPossession) verify(response []byte) error {
+	pop.mu.Lock()
+	defer pop.mu.Unlock()
+
+	mac := hmac.New(sha256.New, pop.secret)
+	mac.Write(pop.challenge)
+	ok := hmac.Equal(mac.Sum(nil), response)
+	if err := pop.rotateLocked(); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("proof-of-possession response does not match challenge")
+	}
+	pop.verified = true
+	return nil
+}
+
+// reset forgets that a client proved possession of the secret and rotates the challenge.
+func (pop *proofOfPossession) reset() error {
+	pop.mu.Lock()
+	defer pop.mu.Unlock()
+
+	pop.verified = false
+	return pop.rotateLocked()
+}
+
+// rotateLocked replaces and publishes the challenge. It must be called with the lock held.
+func (pop *proofOfPossession) rotateLocked() error {
+	challenge, err := newPoPChallenge()
+	if err != nil {
+		return err
+	}
+	pop.challenge = challenge
+	if _, err := pop.challengeHandle.Write(challenge); err != nil {
+		return errors.WithMessage(err, "failed to publish new proof-of-possession challenge")
+	}
+	return nil
+}
+
+// isVerified returns whether a client has proven possession of the secret.
+func (pop *proofOfPossession) isVerified() bool {
+	pop.mu.Lock()
+	defer pop.mu.Unlock()
+	return pop.verified
+}
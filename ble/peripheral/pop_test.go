@@ -0,0 +1,53 @@
+package bleperipheral
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+)
+
+func popResponse(secret, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+func TestProofOfPossession(t *testing.T) {
+	secret := []byte("label secret")
+	pop, err := newProofOfPossession(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := pop.challengeHandle.currentValue()
+	if err := pop.verify(popResponse([]byte("wrong secret"), challenge)); err == nil {
+		t.Fatal("response with the wrong secret was accepted")
+	}
+	if pop.isVerified() {
+		t.Fatal("verified after a wrong response")
+	}
+	if err := pop.verify(popResponse(secret, challenge)); err == nil {
+		t.Fatal("response to a rotated challenge was accepted")
+	}
+
+	challenge = pop.challengeHandle.currentValue()
+	if err := pop.verify(popResponse(secret, challenge)); err != nil {
+		t.Fatalf("valid response was rejected: %v", err)
+	}
+	if !pop.isVerified() {
+		t.Fatal("not verified after a valid response")
+	}
+
+	if err := pop.reset(); err != nil {
+		t.Fatal(err)
+	}
+	if pop.isVerified() {
+		t.Fatal("still verified after reset")
+	}
+	if string(pop.challengeHandle.currentValue()) == string(challenge) {
+		t.Fatal("challenge was not rotated on reset, or the new challenge was not published")
+	}
+	if err := pop.verify(popResponse(secret, pop.challengeHandle.currentValue())); err != nil {
+		t.Fatalf("valid response to the published challenge was rejected: %v", err)
+	}
+}
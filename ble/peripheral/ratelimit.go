@@ -0,0 +1,196 @@
+package bleperipheral
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edaniels/golog"
+	"github.com/pkg/errors"
+)
+
+// RateLimitPolicy limits how often centrals may write to the provisioning service and locks out centrals which fail
+// proof of possession or Wi-Fi connection attempts too often. Locked out centrals are disconnected, and their
+// connections, pairing requests and writes are refused until the lockout ends.
+type RateLimitPolicy struct {
+	// MaxWrites is how many values a central may write per WriteWindow. Writes are not limited if either is zero.
+	MaxWrites   int
+	WriteWindow time.Duration
+	// MaxFailures is how many failed attempts a central may make before it is locked out for LockoutDuration. Centrals
+	// are never locked out if either is zero.
+	MaxFailures     int
+	LockoutDuration time.Duration
+}
+
+// DefaultRateLimitPolicy returns a policy suitable for interactive provisioning from a phone.
+func DefaultRateLimitPolicy() *RateLimitPolicy {
+	return &RateLimitPolicy{
+		MaxWrites:       20,
+		WriteWindow:     10 * time.Second,
+		MaxFailures:     5,
+		LockoutDuration: 5 * time.Minute,
+	}
+}
+
+// unknownCentral stands in for the writer when no central is known to be connected, e.g. because connection events
+// could not be subscribed to, so that unattributed writes are still limited.
+const unknownCentral = ""
+
+// rateLimiter enforces a RateLimitPolicy. BlueZ (through tinygo) does not tell which connection a write came from, so
+// writes and failures are charged to every connected central. With a single connection, as is usual, that is the
+// writer.
+type rateLimiter struct {
+	logger   golog.Logger
+	policy   RateLimitPolicy
+	centrals *centralTracker
+
+	mu          *sync.Mutex
+	writes      map[string][]time.Time // Times of writes within the write window, by upper-case address.
+	failures    map[string]int
+	lockedUntil map[string]time.Time
+	disconnect  func(address string) error // Set by the BLEPeripheral implementation, if it can disconnect centrals.
+}
+
+func newRateLimiter(logger golog.Logger, policy *RateLimitPolicy, centrals *centralTracker) *rateLimiter {
+	if policy == nil {
+		policy = &RateLimitPolicy{}
+	}
+	return &rateLimiter{
+		logger:      logger,
+		policy:      *policy,
+		centrals:    centrals,
+		mu:          &sync.Mutex{},
+		writes:      map[string][]time.Time{},
+		failures:    map[string]int{},
+		lockedUntil: map[string]time.Time{},
+	}
+}
+
+// setDisconnect sets how centrals are disconnected once locked out.
+func (rl *rateLimiter) setDisconnect(disconnect func(address string) error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.disconnect = disconnect
+}
+
+// writers returns the addresses of the centrals writes are charged to.
+func (rl *rateLimiter) writers() []string {
+	centrals := rl.centrals.connectedCentrals()
+	if len(centrals) == 0 {
+		return []string{unknownCentral}
+	}
+	addresses := make([]string, 0, len(centrals))
+	for _, central := range centrals {
+		addresses = append(addresses, central.Address)
+	}
+	return addresses
+}
+
+// checkLockout returns an error if the central with the given address is locked out.
+func (rl *rateLimiter) checkLockout(address string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.checkLockoutLocked(address, time.Now())
+}
+
+func (rl *rateLimiter) checkLockoutLocked(address string, now time.Time) error {
+	key := strings.ToUpper(address)
+	until, ok := rl.lockedUntil[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(until) {
+		delete(rl.lockedUntil, key)
+		return nil
+	}
+	if address == unknownCentral {
+		return errors.Errorf("writes are locked out for %s after too many failed attempts",
+			until.Sub(now).Round(time.Second))
+	}
+	return errors.Errorf("central %s is locked out for %s after too many failed attempts",
+		address, until.Sub(now).Round(time.Second))
+}
+
+// allowWrite records a write by the connected centrals, returning an error if any of them is locked out or has exceeded
+// the write rate.
+func (rl *rateLimiter) allowWrite() error {
+	writers := rl.writers()
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	for _, address := range writers {
+		if err := rl.checkLockoutLocked(address, now); err != nil {
+			return err
+		}
+	}
+	if rl.policy.MaxWrites <= 0 || rl.policy.WriteWindow <= 0 {
+		return nil
+	}
+	var err error
+	for _, address := range writers {
+		key := strings.ToUpper(address)
+		recent := rl.writes[key][:0]
+		for _, t := range rl.writes[key] {
+			if now.Sub(t) < rl.policy.WriteWindow {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) >= rl.policy.MaxWrites {
+			rl.writes[key] = recent
+			err = errors.Errorf("too many writes, at most %d are allowed per %s", rl.policy.MaxWrites,
+				rl.policy.WriteWindow)
+			continue
+		}
+		rl.writes[key] = append(recent, now)
+	}
+	return err
+}
+
+// recordFailure records a failed attempt by the connected centrals, locking out and disconnecting those which reached
+// the maximum number of failures.
+func (rl *rateLimiter) recordFailure(reason string) {
+	if rl.policy.MaxFailures <= 0 || rl.policy.LockoutDuration <= 0 {
+		return
+	}
+	writers := rl.writers()
+	until := time.Now().Add(rl.policy.LockoutDuration)
+
+	rl.mu.Lock()
+	var lockedOut []string
+	for _, address := range writers {
+		key := strings.ToUpper(address)
+		rl.failures[key]++
+		rl.logger.Warnw("recorded failed attempt", "device", address, "reason", reason, "failures", rl.failures[key])
+		if rl.failures[key] < rl.policy.MaxFailures {
+			continue
+		}
+		delete(rl.failures, key)
+		rl.lockedUntil[key] = until
+		lockedOut = append(lockedOut, address)
+	}
+	disconnect := rl.disconnect
+	rl.mu.Unlock()
+
+	for _, address := range lockedOut {
+		rl.logger.Warnw("locked out central after too many failed attempts", "device", address, "until", until)
+		if address == unknownCentral || disconnect == nil {
+			continue
+		}
+		if err := disconnect(address); err != nil {
+			rl.logger.Warnw("failed to disconnect locked out central", "device", address, "err", err)
+		}
+	}
+}
+
+// recordSuccess forgets the failed attempts of the connected centrals.
+func (rl *rateLimiter) recordSuccess() {
+	writers := rl.writers()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, address := range writers {
+		delete(rl.failures, strings.ToUpper(address))
+	}
+}
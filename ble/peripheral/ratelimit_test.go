@@ -0,0 +1,112 @@
+package bleperipheral
+
+import (
+	"testing"
+	"time"
+
+	"github.com/edaniels/golog"
+)
+
+func TestRateLimiterAllowWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   *RateLimitPolicy
+		writes   int
+		rejected int
+	}{
+		{"no policy", nil, 50, 0},
+		{"zero window", &RateLimitPolicy{MaxWrites: 2}, 10, 0},
+		{"within limit", &RateLimitPolicy{MaxWrites: 5, WriteWindow: time.Minute}, 5, 0},
+		{"over limit", &RateLimitPolicy{MaxWrites: 5, WriteWindow: time.Minute}, 8, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			centrals := newCentralTracker(golog.NewTestLogger(t))
+			centrals.connected("AC:DE:48:00:11:22")
+			rl := newRateLimiter(golog.NewTestLogger(t), tc.policy, centrals)
+
+			rejected := 0
+			for i := 0; i < tc.writes; i++ {
+				if rl.allowWrite() != nil {
+					rejected++
+				}
+			}
+			if rejected != tc.rejected {
+				t.Errorf("rejected %d of %d writes, want %d", rejected, tc.writes, tc.rejected)
+			}
+		})
+	}
+}
+
+func TestRateLimiterLockout(t *testing.T) {
+	const address = "AC:DE:48:00:11:22"
+	for _, tc := range []struct {
+		name         string
+		connected    bool
+		failures     int
+		succeedFirst bool
+		lockedOut    bool
+		disconnected []string
+	}{
+		{"below maximum", true, 2, false, false, nil},
+		{"at maximum", true, 3, false, true, []string{address}},
+		{"success forgets failures", true, 3, true, false, nil},
+		{"unknown central", false, 3, false, true, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			centrals := newCentralTracker(golog.NewTestLogger(t))
+			if tc.connected {
+				centrals.connected(address)
+			}
+			rl := newRateLimiter(golog.NewTestLogger(t),
+				&RateLimitPolicy{MaxFailures: 3, LockoutDuration: time.Minute}, centrals)
+			var disconnected []string
+			rl.setDisconnect(func(address string) error {
+				disconnected = append(disconnected, address)
+				return nil
+			})
+
+			for i := 0; i < tc.failures; i++ {
+				if tc.succeedFirst && i == tc.failures-1 {
+					rl.recordSuccess()
+				}
+				rl.recordFailure("test")
+			}
+
+			writer := unknownCentral
+			if tc.connected {
+				writer = address
+			}
+			if err := rl.checkLockout(writer); (err != nil) != tc.lockedOut {
+				t.Errorf("checkLockout = %v, want locked out %t", err, tc.lockedOut)
+			}
+			if err := rl.allowWrite(); (err != nil) != tc.lockedOut {
+				t.Errorf("allowWrite = %v, want locked out %t", err, tc.lockedOut)
+			}
+			if len(disconnected) != len(tc.disconnected) ||
+				(len(disconnected) > 0 && disconnected[0] != tc.disconnected[0]) {
+				t.Errorf("disconnected %q, want %q", disconnected, tc.disconnected)
+			}
+			if _, err := deviceObjectPath("/org/bluez/hci0", writer); tc.connected && err != nil {
+				t.Errorf("cannot disconnect locked out central: %v", err)
+			}
+		})
+	}
+}
+
+func TestRateLimiterLockoutExpires(t *testing.T) {
+	const address = "ac:de:48:00:11:22"
+	rl := newRateLimiter(golog.NewTestLogger(t), &RateLimitPolicy{MaxFailures: 1, LockoutDuration: time.Minute},
+		newCentralTracker(golog.NewTestLogger(t)))
+	rl.lockedUntil["AC:DE:48:00:11:22"] = time.Now().Add(time.Minute)
+
+	now := time.Now()
+	if err := rl.checkLockoutLocked(address, now); err == nil {
+		t.Error("central is not locked out")
+	}
+	if err := rl.checkLockoutLocked(address, now.Add(time.Minute)); err != nil {
+		t.Errorf("central is still locked out once the lockout ended: %v", err)
+	}
+	if _, ok := rl.lockedUntil["AC:DE:48:00:11:22"]; ok {
+		t.Error("ended lockout was not forgotten")
+	}
+}
@@ -0,0 +1,86 @@
+package bleperipheral
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultLongWriteCommitDelay is how long a value may go without new fragments before it is committed. Fragments of a
+// long write are delivered back to back when the client executes its prepared writes, so this can be short.
+const defaultLongWriteCommitDelay = 250 * time.Millisecond
+
+// writeAssembler reassembles values which exceed the negotiated MTU and are therefore written in fragments (ATT long
+// writes deliver one write per fragment, each with its offset into the value). A value is committed once no further
+// fragment has arrived for commitDelay; until then, readers keep seeing the previously committed value.
+type writeAssembler struct {
+	mu          *sync.Mutex
+	pending     []byte
+	generation  uint64 // Incremented on every fragment, so that a stale commit timer can recognize it is stale.
+	timer       *time.Timer
+	commitDelay time.Duration
+	commit      func(value []byte)
+}
+
+func newWriteAssembler(commitDelay time.Duration, commit func(value []byte)) *writeAssembler {
+	return &writeAssembler{
+		mu:          &sync.Mutex{},
+		commitDelay: commitDelay,
+		commit:      commit,
+	}
+}
+
+// write adds a fragment at the given offset. A fragment at offset 0 starts a new value; any other fragment must
+// continue exactly where the previous one ended, or the incomplete value is discarded.
+func (wa *writeAssembler) write(offset int, fragment []byte) error {
+	wa.mu.Lock()
+	defer wa.mu.Unlock()
+
+	wa.generation++
+	if wa.timer != nil {
+		wa.timer.Stop()
+		wa.timer = nil
+	}
+	switch offset {
+	case 0:
+		wa.pending = append([]byte{}, fragment...) // Non-nil even if empty, as empty values (e.g. PSKs) are valid.
+	case len(wa.pending):
+		wa.pending = append(wa.pending, fragment...)
+	default:
+		expected := len(wa.pending)
+		wa.pending = nil
+		return errors.Errorf("received fragment at offset %d, expected offset 0 or %d", offset, expected)
+	}
+	generation := wa.generation
+	wa.timer = time.AfterFunc(wa.commitDelay, func() {
+		wa.flush(generation)
+	})
+	return nil
+}
+
+// flushNow commits the pending value immediately, if there is one.
+func (wa *writeAssembler) flushNow() {
+	wa.mu.Lock()
+	generation := wa.generation
+	wa.mu.Unlock()
+	wa.flush(generation)
+}
+
+// flush commits the pending value, unless more fragments have arrived since the timer for generation was started.
+func (wa *writeAssembler) flush(generation uint64) {
+	wa.mu.Lock()
+	if generation != wa.generation || wa.pending == nil {
+		wa.mu.Unlock()
+		return
+	}
+	value := wa.pending
+	wa.pending = nil
+	if wa.timer != nil {
+		wa.timer.Stop()
+		wa.timer = nil
+	}
+	wa.mu.Unlock()
+
+	wa.commit(value)
+}
@@ -0,0 +1,87 @@
+package bleperipheral
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fragment struct {
+	offset int
+	value  string
+}
+
+func TestWriteAssembler(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		fragments []fragment
+		errors    int
+		committed []string
+	}{
+		{"single write", []fragment{{0, "net"}}, 0, []string{"net"}},
+		{"long write", []fragment{{0, "pass"}, {4, "wor"}, {7, "d1"}}, 0, []string{"password1"}},
+		{"restarted value", []fragment{{0, "wrong"}, {0, "pass"}, {4, "word1"}}, 0, []string{"password1"}},
+		{"gap", []fragment{{0, "pass"}, {6, "rd1"}}, 1, nil},
+		{"overlap", []fragment{{0, "pass"}, {2, "ssword1"}}, 1, nil},
+		{"recovered after gap", []fragment{{0, "pass"}, {6, "rd1"}, {0, "net"}}, 1, []string{"net"}},
+		{"out of order start", []fragment{{3, "work"}, {0, "net"}}, 1, []string{"net"}},
+		{"empty value", []fragment{{0, ""}}, 0, []string{""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var committed []string
+			wa := newWriteAssembler(time.Hour, func(value []byte) {
+				committed = append(committed, string(value))
+			})
+			errors := 0
+			for _, f := range tc.fragments {
+				if wa.write(f.offset, []byte(f.value)) != nil {
+					errors++
+				}
+			}
+			if len(committed) != 0 {
+				t.Fatalf("committed %q before the commit delay passed", committed)
+			}
+			wa.flushNow()
+			wa.flushNow()
+
+			if errors != tc.errors {
+				t.Errorf("%d fragments were rejected, want %d", errors, tc.errors)
+			}
+			if len(committed) != len(tc.committed) || (len(committed) > 0 && committed[0] != tc.committed[0]) {
+				t.Errorf("committed %q, want %q", committed, tc.committed)
+			}
+		})
+	}
+}
+
+func TestWriteAssemblerCommitDelay(t *testing.T) {
+	mu := &sync.Mutex{}
+	var committed []string
+	done := make(chan struct{})
+	wa := newWriteAssembler(50*time.Millisecond, func(value []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		committed = append(committed, string(value))
+		close(done)
+	})
+
+	if err := wa.write(0, []byte("pass")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(25 * time.Millisecond)
+	if err := wa.write(4, []byte("word1")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("value was not committed after the commit delay")
+	}
+	wa.flushNow()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(committed) != 1 || committed[0] != "password1" {
+		t.Errorf("committed %q, want the reassembled value once", committed)
+	}
+}
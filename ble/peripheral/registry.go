@@ -0,0 +1,244 @@
+package bleperipheral
+
+import (
+	"encoding/json"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+// Names of the characteristics every peripheral declares for provisioning credentials.
+const (
+	SsidCharacteristic           = "ssid"
+	PskCharacteristic            = "psk"
+	RobotPartKeyIDCharacteristic = "robot_part_key_id"
+	RobotPartKeyCharacteristic   = "robot_part_key"
+)
+
+// Codec converts between the Go value of a characteristic and the bytes exchanged with clients.
+type Codec[T any] interface {
+	Encode(T) ([]byte, error)
+	Decode([]byte) (T, error)
+}
+
+// StringCodec encodes strings as raw UTF-8 bytes.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(b []byte) (string, error) {
+	if !utf8.Valid(b) {
+		return "", errors.New("value is not valid UTF-8")
+	}
+	return string(b), nil
+}
+
+// JSONCodec encodes values as JSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// WithWritableCharacteristic declares a characteristic which clients write a value of type T to, and which can be read
+// on the device with Read. Writes go through the same reassembly, decryption and proof-of-possession checks as the
+// built-in credential characteristics, and values are only committed if every validator accepts them.
+func WithWritableCharacteristic[T any](name string, component uint16, codec Codec[T], validators ...Validator[T]) Option {
+	return func(o *options) {
+		char := newLinuxBLECharacteristic(name, component, codec, true)
+		char.validators = validators
+		o.characteristics = append(o.characteristics, char)
+	}
+}
+
+// WithReadableCharacteristic declares a characteristic which clients read a value of type T from, and which can be
+// updated on the device with Write.
+func WithReadableCharacteristic[T any](name string, component uint16, codec Codec[T], initial T) Option {
+	return func(o *options) {
+		char := newLinuxBLECharacteristic(name, component, codec, false)
+		char.currentValue = &initial
+		o.characteristics = append(o.characteristics, char)
+	}
+}
+
+// defaultCharacteristics returns the characteristics every peripheral declares for provisioning credentials.
+func defaultCharacteristics() []characteristic {
+	credential := func(name string, component uint16, validator Validator[string]) characteristic {
+		char := newLinuxBLECharacteristic[string](name, component, StringCodec{}, true)
+		char.validators = []Validator[string]{validator}
+		return char
+	}
+	return []characteristic{
+		credential(SsidCharacteristic, SsidUUIDComponent, ValidateSSID),
+		credential(PskCharacteristic, PskUUIDComponent, ValidatePSK),
+		credential(RobotPartKeyIDCharacteristic, RobotPartKeyIDUUIDComponent, ValidateRobotPartKeyID),
+		credential(RobotPartKeyCharacteristic, RobotPartKeyUUIDComponent, ValidateRobotPartKey),
+	}
+}
+
+// Read returns the current value of the characteristic declared with the given name.
+func Read[T any](p BLEPeripheral, name string) (T, error) {
+	var zero T
+	v, err := p.ReadValue(name)
+	if err != nil {
+		return zero, err
+	}
+	t, ok := v.(T)
+	if !ok {
+		return zero, errors.Errorf("characteristic %s holds a %T, not a %T", name, v, zero)
+	}
+	return t, nil
+}
+
+// Write updates the value of the readable characteristic declared with the given name.
+func Write[T any](p BLEPeripheral, name string, value T) error {
+	return p.WriteValue(name, value)
+}
+
+// characteristic erases the value type of a linuxBLECharacteristic, so that characteristics of different types can be
+// declared together.
+type characteristic interface {
+	name() string
+	component() uint16
+	config(uuid bluetooth.UUID, wp *writePipeline) (gattCharacteristic, error)
+	read() (any, error)
+	write(any) error
+	clear()
+}
+
+type linuxBLECharacteristic[T any] struct {
+	UUID     bluetooth.UUID
+	label    string
+	uuid16   uint16
+	codec    Codec[T]
+	writable bool // Writable by clients, otherwise readable by clients and written by the device.
+	mu       *sync.Mutex
+	active   bool // Currently non-functional, but should be used to make characteristics optional.
+
+	validators []Validator[T] // Only used by characteristics writable by clients.
+
+	handle       *characteristicHandle // Only used by characteristics readable by clients.
+	currentValue *T
+}
+
+func newLinuxBLECharacteristic[T any](
+	name string, component uint16, codec Codec[T], writable bool,
+) *linuxBLECharacteristic[T] {
+	return &linuxBLECharacteristic[T]{
+		label:    name,
+		uuid16:   component,
+		codec:    codec,
+		writable: writable,
+		mu:       &sync.Mutex{},
+		active:   true,
+	}
+}
+
+func (c *linuxBLECharacteristic[T]) name() string {
+	return c.label
+}
+
+func (c *linuxBLECharacteristic[T]) component() uint16 {
+	return c.uuid16
+}
+
+func (c *linuxBLECharacteristic[T]) config(uuid bluetooth.UUID, wp *writePipeline) (gattCharacteristic, error) {
+	c.UUID = uuid
+	if c.writable {
+		return gattCharacteristic{
+			CharacteristicConfig: bluetooth.CharacteristicConfig{
+				UUID:       uuid,
+				Flags:      bluetooth.CharacteristicWritePermission,
+				WriteEvent: wp.writeEvent(c.label, uuid, c.commit),
+			},
+		}, nil
+	}
+
+	var value []byte
+	if c.currentValue != nil {
+		var err error
+		if value, err = c.codec.Encode(*c.currentValue); err != nil {
+			return gattCharacteristic{}, errors.WithMessagef(err, "failed to encode initial value of %s", c.label)
+		}
+	}
+	c.handle = newCharacteristicHandle(value)
+	return gattCharacteristic{
+		CharacteristicConfig: bluetooth.CharacteristicConfig{
+			UUID:  uuid,
+			Flags: bluetooth.CharacteristicReadPermission,
+		},
+		handle: c.handle,
+	}, nil
+}
+
+// commit stores a complete value written by a client.
+func (c *linuxBLECharacteristic[T]) commit(value []byte) error {
+	v, err := c.codec.Decode(value)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to decode %s", c.label)
+	}
+	for _, validate := range c.validators {
+		if err := validate(v); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.currentValue = &v
+	return nil
+}
+
+func (c *linuxBLECharacteristic[T]) read() (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active {
+		return nil, errors.Errorf("characteristic %s is inactive", c.label)
+	}
+	if c.currentValue == nil {
+		return nil, newErrBLECharNoValue(c.label)
+	}
+	return *c.currentValue, nil
+}
+
+func (c *linuxBLECharacteristic[T]) write(value any) error {
+	if c.writable {
+		return errors.Errorf("characteristic %s is written by clients", c.label)
+	}
+	v, ok := value.(T)
+	if !ok {
+		return errors.Errorf("characteristic %s cannot hold a %T", c.label, value)
+	}
+	bs, err := c.codec.Encode(v)
+	if err != nil {
+		return errors.WithMessagef(err, "failed to encode %s", c.label)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.handle.Write(bs); err != nil {
+		return errors.WithMessagef(err, "failed to write %s to bluetooth characteristic", c.label)
+	}
+	c.currentValue = &v
+	return nil
+}
+
+// clear forgets the value written by clients, if the characteristic is writable by them.
+func (c *linuxBLECharacteristic[T]) clear() {
+	if !c.writable {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.currentValue = nil
+}
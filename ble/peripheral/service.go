@@ -0,0 +1,584 @@
+package bleperipheral
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/edaniels/golog"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"tinygo.org/x/bluetooth"
+)
+
+// characteristicHandle holds the value of a characteristic published by the device. Once bound to the characteristic
+// registered with a GATT server, every new value is written through to it, and so reaches clients.
+type characteristicHandle struct {
+	mu    *sync.Mutex
+	value []byte
+	sink  io.Writer
+}
+
+func newCharacteristicHandle(value []byte) *characteristicHandle {
+	return &characteristicHandle{
+		mu:    &sync.Mutex{},
+		value: value,
+	}
+}
+
+// Write publishes a new value of the characteristic.
+func (h *characteristicHandle) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.sink != nil {
+		if _, err := h.sink.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	h.value = append([]byte(nil), p...)
+	return len(p), nil
+}
+
+// currentValue returns the last value published.
+func (h *characteristicHandle) currentValue() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.value
+}
+
+// bind writes all future values through to sink, starting with the current value.
+func (h *characteristicHandle) bind(sink io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.value) > 0 {
+		if _, err := sink.Write(h.value); err != nil {
+			return err
+		}
+	}
+	h.sink = sink
+	return nil
+}
+
+// gattCharacteristic describes a characteristic of the provisioning service independently of the GATT server it is
+// registered with. The Handle field of the embedded config is left to the GATT server.
+type gattCharacteristic struct {
+	bluetooth.CharacteristicConfig
+	handle *characteristicHandle // Only set for characteristics whose value is published by the device.
+}
+
+// provisioningService implements the provisioning protocol on top of a set of GATT characteristics, leaving their
+// registration with a GATT server (and advertising) to the BLEPeripheral implementation embedding it.
+type provisioningService struct {
+	logger golog.Logger
+
+	UUID            bluetooth.UUID
+	baseUUID        uuid.UUID
+	gattChars       []gattCharacteristic
+	characteristics map[string]characteristic
+
+	wp       *writePipeline
+	status   *statusMachine
+	commands *commandDispatcher
+	centrals *centralTracker
+	limiter  *rateLimiter
+	window   *advertisingWindow
+
+	companyID uint16
+	deviceID  []byte
+
+	networks *networksUpdater
+}
+
+func newProvisioningService(ctx context.Context, logger golog.Logger, o *options) (*provisioningService, error) {
+	serviceUUID := DeriveUUID(o.baseUUID, ServiceUUIDComponent)
+	logger.Infof("serviceUUID: %s", serviceUUID.String())
+	charAvailableWiFiNetworksUUID := DeriveUUID(o.baseUUID, AvailableWiFiNetworksUUIDComponent)
+	logger.Infof("charAvailableWiFiNetworksUUID: %s", charAvailableWiFiNetworksUUID.String())
+
+	// Credential writes are rejected until the client completes the proof-of-possession challenge, if one is configured.
+	popSecret := o.popSecret
+	if o.popSecretFile != "" {
+		var err error
+		if popSecret, err = readPoPSecretFile(o.popSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	var pop *proofOfPossession
+	if popSecret != nil {
+		var err error
+		if pop, err = newProofOfPossession(popSecret); err != nil {
+			return nil, errors.WithMessage(err, "failed to set up proof of possession")
+		}
+	}
+
+	// Credentials must be encrypted with a session key negotiated over the key exchange characteristics, if enabled.
+	// The proof-of-possession secret, if any, is mixed into the session key.
+	var session *encryptionSession
+	if o.encryptCredentials {
+		var err error
+		if session, err = newEncryptionSession(popSecret); err != nil {
+			return nil, errors.WithMessage(err, "failed to set up credential encryption")
+		}
+	}
+
+	// Create a characteristic for every declared field, starting with the credentials and the device info. Values
+	// written by the client are decrypted on write when encryption is enabled, so that reads return plaintext.
+	deviceInfo := o.deviceInfo
+	if deviceInfo == nil {
+		deviceInfo = &DeviceInfo{SerialNumber: o.serialNumber}
+	}
+	rejections, err := newRejectionReporter()
+	if err != nil {
+		return nil, err
+	}
+	centrals := newCentralTracker(logger)
+	limiter := newRateLimiter(logger, o.rateLimitPolicy, centrals)
+	wp := newWritePipeline(logger, session, pop, rejections, limiter, o.longWriteCommitDelay)
+	characteristics := map[string]characteristic{}
+	components := reservedUUIDComponents()
+	var gattChars []gattCharacteristic
+	declared := append(defaultCharacteristics(), deviceInfoCharacteristics(deviceInfo)...)
+	for _, char := range append(declared, o.characteristics...) {
+		if _, ok := characteristics[char.name()]; ok {
+			return nil, errors.Errorf("characteristic %s declared more than once", char.name())
+		}
+		if other, ok := components[char.component()]; ok {
+			return nil, errors.Errorf("characteristic %s uses UUID component %#04x, which is taken by %s",
+				char.name(), char.component(), other)
+		}
+		charUUID := DeriveUUID(o.baseUUID, char.component())
+		logger.Infof("characteristic %s UUID: %s", char.name(), charUUID.String())
+		gattChar, err := char.config(charUUID, wp)
+		if err != nil {
+			return nil, err
+		}
+		characteristics[char.name()] = char
+		components[char.component()] = char.name()
+		gattChars = append(gattChars, gattChar)
+	}
+
+	// Create a read-only, notifying characteristic for broadcasting nearby, available WiFi networks. It holds one page
+	// of networks at a time, so that the list can be read in full regardless of its size or the negotiated MTU.
+	pager, err := newNetworksPager(o.networksPageSize)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to paginate available WiFi networks")
+	}
+	gattChars = append(gattChars, gattCharacteristic{
+		CharacteristicConfig: bluetooth.CharacteristicConfig{
+			UUID:       charAvailableWiFiNetworksUUID,
+			Flags:      bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+			WriteEvent: nil, // This characteristic is read-only.
+		},
+		// Every call to UpdateAvailableWiFiNetworks, and every page selected, is written through the handle to the
+		// registered characteristic, which notifies subscribers.
+		handle: pager.handle,
+	})
+
+	// Create a write-only characteristic for selecting which page of available WiFi networks is served.
+	charNetworksPageIndexUUID := DeriveUUID(o.baseUUID, NetworksPageIndexUUIDComponent)
+	logger.Infof("charNetworksPageIndexUUID: %s", charNetworksPageIndexUUID.String())
+	gattChars = append(gattChars, gattCharacteristic{
+		CharacteristicConfig: bluetooth.CharacteristicConfig{
+			UUID:  charNetworksPageIndexUUID,
+			Flags: bluetooth.CharacteristicWritePermission,
+			WriteEvent: func(client bluetooth.Connection, offset int, value []byte) {
+				if err := pager.selectPage(value); err != nil {
+					logger.Errorw("failed to select page of available WiFi networks", "err", err)
+				}
+			},
+		},
+	})
+
+	// Create a read-only, notifying characteristic which reports the progress of provisioning.
+	status, err := newStatusMachine()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to set up provisioning status")
+	}
+	deviceID, err := advertisedDeviceID(o, deviceInfo.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	charStatusUUID := DeriveUUID(o.baseUUID, StatusUUIDComponent)
+	logger.Infof("charStatusUUID: %s", charStatusUUID.String())
+	gattChars = append(gattChars, gattCharacteristic{
+		CharacteristicConfig: bluetooth.CharacteristicConfig{
+			UUID:  charStatusUUID,
+			Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+		},
+		handle: status.handle,
+	})
+
+	// Create a read-only, notifying characteristic which reports why the last write to a characteristic was rejected.
+	charWriteRejectionUUID := DeriveUUID(o.baseUUID, WriteRejectionUUIDComponent)
+	logger.Infof("charWriteRejectionUUID: %s", charWriteRejectionUUID.String())
+	gattChars = append(gattChars, gattCharacteristic{
+		CharacteristicConfig: bluetooth.CharacteristicConfig{
+			UUID:  charWriteRejectionUUID,
+			Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+		},
+		handle: rejections.handle,
+	})
+
+	// Create a write-only characteristic accepting commands, which are passed to the handlers registered for them.
+	commands := newCommandDispatcher()
+	charCommandUUID := DeriveUUID(o.baseUUID, CommandUUIDComponent)
+	logger.Infof("charCommandUUID: %s", charCommandUUID.String())
+	gattChars = append(gattChars, gattCharacteristic{
+		CharacteristicConfig: bluetooth.CharacteristicConfig{
+			UUID:       charCommandUUID,
+			Flags:      bluetooth.CharacteristicWritePermission,
+			WriteEvent: wp.writeEvent("command", charCommandUUID, commands.dispatch),
+		},
+	})
+
+	// Create a read-only, notifying characteristic exposing the current and supported payload encodings and a
+	// write-only characteristic accepting the encoding selected by the client.
+	encodings := newEncodingNegotiator(pager.setEncoding, status.setEncoding, rejections.setEncoding)
+	charEncodingUUID := DeriveUUID(o.baseUUID, EncodingUUIDComponent)
+	logger.Infof("charEncodingUUID: %s", charEncodingUUID.String())
+	charEncodingSelectionUUID := DeriveUUID(o.baseUUID, EncodingSelectionUUIDComponent)
+	logger.Infof("charEncodingSelectionUUID: %s", charEncodingSelectionUUID.String())
+	gattChars = append(gattChars,
+		gattCharacteristic{
+			CharacteristicConfig: bluetooth.CharacteristicConfig{
+				UUID:  charEncodingUUID,
+				Flags: bluetooth.CharacteristicReadPermission | bluetooth.CharacteristicNotifyPermission,
+			},
+			handle: encodings.handle,
+		},
+		gattCharacteristic{
+			CharacteristicConfig: bluetooth.CharacteristicConfig{
+				UUID:  charEncodingSelectionUUID,
+				Flags: bluetooth.CharacteristicWritePermission,
+				WriteEvent: wp.assembledWriteEvent("encoding selection", func(value []byte) {
+					if err := encodings.selectEncoding(value); err != nil {
+						wp.reject("encoding selection", err)
+						return
+					}
+					logger.Infow("client selected payload encoding", "encoding", Encoding(value[0]))
+				}),
+			},
+		},
+	)
+
+	if session != nil {
+		// Create a read-only characteristic exposing the device's public key and a write-only characteristic
+		// accepting the client's public key, from which both sides derive the session key.
+		charDevicePublicKeyUUID := DeriveUUID(o.baseUUID, DevicePublicKeyUUIDComponent)
+		logger.Infof("charDevicePublicKeyUUID: %s", charDevicePublicKeyUUID.String())
+		charClientPublicKeyUUID := DeriveUUID(o.baseUUID, ClientPublicKeyUUIDComponent)
+		logger.Infof("charClientPublicKeyUUID: %s", charClientPublicKeyUUID.String())
+		gattChars = append(gattChars,
+			gattCharacteristic{
+				CharacteristicConfig: bluetooth.CharacteristicConfig{
+					UUID:  charDevicePublicKeyUUID,
+					Flags: bluetooth.CharacteristicReadPermission,
+				},
+				handle: session.publicKeyHandle,
+			},
+			gattCharacteristic{
+				CharacteristicConfig: bluetooth.CharacteristicConfig{
+					UUID:  charClientPublicKeyUUID,
+					Flags: bluetooth.CharacteristicWritePermission,
+					WriteEvent: wp.assembledWriteEvent("client public key", func(value []byte) {
+						if err := session.establish(value); err != nil {
+							logger.Errorw("failed to establish encryption session", "err", err)
+							return
+						}
+						logger.Info("established encryption session")
+					}),
+				},
+			},
+		)
+	}
+	if pop != nil {
+		// Create a read-only characteristic exposing the current challenge and a write-only characteristic
+		// accepting the client's response to it.
+		charPoPChallengeUUID := DeriveUUID(o.baseUUID, PoPChallengeUUIDComponent)
+		logger.Infof("charPoPChallengeUUID: %s", charPoPChallengeUUID.String())
+		charPoPResponseUUID := DeriveUUID(o.baseUUID, PoPResponseUUIDComponent)
+		logger.Infof("charPoPResponseUUID: %s", charPoPResponseUUID.String())
+		gattChars = append(gattChars,
+			gattCharacteristic{
+				CharacteristicConfig: bluetooth.CharacteristicConfig{
+					UUID:  charPoPChallengeUUID,
+					Flags: bluetooth.CharacteristicReadPermission,
+				},
+				handle: pop.challengeHandle,
+			},
+			gattCharacteristic{
+				CharacteristicConfig: bluetooth.CharacteristicConfig{
+					UUID:  charPoPResponseUUID,
+					Flags: bluetooth.CharacteristicWritePermission,
+					WriteEvent: wp.assembledWriteEvent("proof-of-possession response", func(value []byte) {
+						if err := pop.verify(value); err != nil {
+							logger.Errorw("proof of possession failed", "err", err)
+							limiter.recordFailure("proof of possession failed")
+							return
+						}
+						limiter.recordSuccess()
+						logger.Info("client proved possession of device secret, accepting credentials")
+					}),
+				},
+			},
+		)
+	}
+
+	ps := &provisioningService{
+		logger: logger,
+
+		UUID:            serviceUUID,
+		baseUUID:        o.baseUUID,
+		gattChars:       gattChars,
+		characteristics: characteristics,
+
+		wp:       wp,
+		status:   status,
+		commands: commands,
+		centrals: centrals,
+		limiter:  limiter,
+		window:   newAdvertisingWindow(o.advertisingTimeout),
+
+		companyID: o.manufacturerCompanyID,
+		deviceID:  deviceID,
+
+		networks: startNetworksUpdater(ctx, logger, pager),
+	}
+
+	// Payloads are JSON again once every central disconnects, so that the next client need not know the handshake, and
+	// the next client must prove possession of the secret again. This is done as the last central disconnects, rather
+	// than by a subscriber to connection events, which may drop them.
+	centrals.setLastDisconnect(func() {
+		if err := encodings.use(EncodingJSON); err != nil {
+			logger.Errorw("failed to restore JSON payload encoding", "err", err)
+		}
+		if err := ps.resetAuthentication(); err != nil {
+			logger.Errorw("failed to reset client authentication", "err", err)
+		}
+	})
+	return ps, nil
+}
+
+// bluetoothService returns the service to register with a bluetooth adapter, after which bindHandles must be called.
+func (ps *provisioningService) bluetoothService() *bluetooth.Service {
+	s := &bluetooth.Service{UUID: ps.UUID}
+	for _, gattChar := range ps.gattChars {
+		config := gattChar.CharacteristicConfig
+		if gattChar.handle != nil {
+			config.Handle = &bluetooth.Characteristic{}
+			config.Value = gattChar.handle.currentValue()
+		}
+		s.Characteristics = append(s.Characteristics, config)
+	}
+	return s
+}
+
+// bindHandles writes all values published by the device through to the characteristics of the registered service.
+func (ps *provisioningService) bindHandles(s *bluetooth.Service) error {
+	for i, gattChar := range ps.gattChars {
+		if gattChar.handle == nil {
+			continue
+		}
+		if err := gattChar.handle.bind(s.Characteristics[i].Handle); err != nil {
+			return errors.WithMessagef(err, "failed to bind bluetooth characteristic %s", gattChar.UUID.String())
+		}
+	}
+	return nil
+}
+
+// UpdateAvailableWiFiNetworks replaces the available WiFi networks served to clients. It does not wait for the update
+// to be published, and only the latest of several updates in quick succession may be. It returns an error once the
+// context the peripheral was created with is done.
+func (ps *provisioningService) UpdateAvailableWiFiNetworks(awns *AvailableWiFiNetworks) error {
+	return ps.networks.update(awns)
+}
+
+// UpdateStatus reports a new provisioning status to clients subscribed to the status characteristic.
+func (ps *provisioningService) UpdateStatus(status *ProvisioningStatus) error {
+	if err := ps.status.transition(status); err != nil {
+		return err
+	}
+	ps.logger.Infow("updated provisioning status", "state", status.State, "reason", status.Reason)
+	switch status.State {
+	case StateFailed:
+		ps.limiter.recordFailure("provisioning failed: " + status.Reason)
+	case StateConnected:
+		ps.limiter.recordSuccess()
+	}
+	return nil
+}
+
+// HandleCommand registers the handler for a command written by clients, replacing any registered before.
+func (ps *provisioningService) HandleCommand(command Command, handler CommandHandler) {
+	ps.commands.handle(command, handler)
+}
+
+// resetSession clears every value written by clients and the last write rejection, then reports StateWaiting with
+// updateStatus, which is reachable from every state.
+func (ps *provisioningService) resetSession(updateStatus func(*ProvisioningStatus) error) error {
+	for _, char := range ps.characteristics {
+		char.clear()
+	}
+	if err := ps.wp.rejections.clear(); err != nil {
+		return err
+	}
+	if err := ps.resetAuthentication(); err != nil {
+		return err
+	}
+	if err := updateStatus(&ProvisioningStatus{State: StateWaiting}); err != nil {
+		return err
+	}
+	ps.logger.Info("reset provisioning session")
+	return nil
+}
+
+// resetAuthentication requires clients to prove possession of the secret again, if proof of possession is configured,
+// and to exchange keys with a new device key pair, if credentials are encrypted. It is called at the end of every
+// session: when the last central disconnects, the session is reset or advertising stops.
+func (ps *provisioningService) resetAuthentication() error {
+	var popErr, sessionErr error
+	if ps.wp.pop != nil {
+		popErr = ps.wp.pop.reset()
+	}
+	if ps.wp.session != nil {
+		sessionErr = ps.wp.session.reset()
+	}
+	return multierr.Combine(popErr, sessionErr)
+}
+
+// ConnectedCentrals returns the centrals currently connected, ordered by when they connected.
+func (ps *provisioningService) ConnectedCentrals() []Central {
+	return ps.centrals.connectedCentrals()
+}
+
+// SubscribeConnectionEvents returns a channel of connection events from now on, which is closed once ctx is done.
+// Events are dropped if the subscriber falls behind.
+func (ps *provisioningService) SubscribeConnectionEvents(ctx context.Context) <-chan ConnectionEvent {
+	return ps.centrals.subscribe(ctx)
+}
+
+// AdvertisingTimeout returns a channel which is closed once advertising stops because the advertising window elapsed,
+// or nil if advertising is not limited (see WithAdvertisingTimeout). A new channel is returned for every window.
+func (ps *provisioningService) AdvertisingTimeout() <-chan struct{} {
+	return ps.window.done()
+}
+
+// ReadValue returns the current value of the characteristic declared with the given name.
+func (ps *provisioningService) ReadValue(name string) (any, error) {
+	char, ok := ps.characteristics[name]
+	if !ok {
+		return nil, errors.Errorf("no characteristic named %s", name)
+	}
+	return char.read()
+}
+
+// WriteValue updates the value of the readable characteristic declared with the given name.
+func (ps *provisioningService) WriteValue(name string, value any) error {
+	char, ok := ps.characteristics[name]
+	if !ok {
+		return errors.Errorf("no characteristic named %s", name)
+	}
+	return char.write(value)
+}
+
+// writePipeline processes values written by clients before they are committed to a characteristic. Values are never
+// logged, as they may be secrets.
+type writePipeline struct {
+	logger      golog.Logger
+	session     *encryptionSession // If non-nil, values must be encrypted with the session key.
+	pop         *proofOfPossession // If non-nil, values are rejected until proof of possession has been verified.
+	rejections  *rejectionReporter
+	limiter     *rateLimiter
+	commitDelay time.Duration
+
+	mu         *sync.Mutex
+	assemblers []*writeAssembler
+}
+
+func newWritePipeline(
+	logger golog.Logger,
+	session *encryptionSession,
+	pop *proofOfPossession,
+	rejections *rejectionReporter,
+	limiter *rateLimiter,
+	commitDelay time.Duration,
+) *writePipeline {
+	return &writePipeline{
+		logger:      logger,
+		session:     session,
+		pop:         pop,
+		rejections:  rejections,
+		limiter:     limiter,
+		commitDelay: commitDelay,
+		mu:          &sync.Mutex{},
+	}
+}
+
+// writeEvent returns a handler which reassembles values written to the characteristic with the given name and UUID,
+// decrypts them if required, and passes them to commit. The reason for rejecting a value is published to the client.
+func (wp *writePipeline) writeEvent(name string, uuid bluetooth.UUID, commit func([]byte) error) bluetooth.WriteEvent {
+	return wp.assembledWriteEvent(name, func(value []byte) {
+		if wp.pop != nil && !wp.pop.isVerified() {
+			wp.reject(name, errors.New("proof of possession has not been verified"))
+			return
+		}
+		if wp.session != nil {
+			plaintext, err := wp.session.decrypt(value, []byte(uuid.String()))
+			if err != nil {
+				wp.reject(name, err)
+				return
+			}
+			value = plaintext
+		}
+		if err := commit(value); err != nil {
+			wp.reject(name, err)
+			return
+		}
+		if err := wp.rejections.accept(name); err != nil {
+			wp.logger.Errorw("failed to clear write rejection", "characteristic", name, "err", err)
+		}
+		wp.logger.Infof("received %s (%d bytes)", name, len(value))
+	})
+}
+
+// reject logs why a value written to the characteristic with the given name was rejected and publishes it.
+func (wp *writePipeline) reject(name string, reason error) {
+	wp.logger.Errorw("rejected write", "characteristic", name, "err", reason)
+	if err := wp.rejections.reject(name, reason); err != nil {
+		wp.logger.Errorw("failed to publish write rejection", "characteristic", name, "err", err)
+	}
+}
+
+// assembledWriteEvent returns a handler which reassembles fragmented writes and passes each complete value to commit,
+// unless the rate limit is exceeded.
+func (wp *writePipeline) assembledWriteEvent(name string, commit func(value []byte)) bluetooth.WriteEvent {
+	wa := newWriteAssembler(wp.commitDelay, func(value []byte) {
+		if err := wp.limiter.allowWrite(); err != nil {
+			wp.reject(name, err)
+			return
+		}
+		commit(value)
+	})
+	wp.mu.Lock()
+	wp.assemblers = append(wp.assemblers, wa)
+	wp.mu.Unlock()
+	return func(client bluetooth.Connection, offset int, value []byte) {
+		if err := wa.write(offset, value); err != nil {
+			wp.logger.Errorw("discarded incomplete write", "characteristic", name, "err", err)
+		}
+	}
+}
+
+// flush commits all pending values immediately, rather than waiting for the commit delay to pass.
+func (wp *writePipeline) flush() {
+	wp.mu.Lock()
+	assemblers := wp.assemblers
+	wp.mu.Unlock()
+	for _, wa := range assemblers {
+		wa.flushNow()
+	}
+}
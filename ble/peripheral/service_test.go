@@ -0,0 +1,224 @@
+package bleperipheral
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/edaniels/golog"
+)
+
+const testCentral = "AC:DE:48:00:11:22"
+
+func newTestPeripheral(ctx context.Context, t *testing.T, opts ...Option) *MemoryBLEPeripheral {
+	t.Helper()
+	m, err := NewMemoryBLEPeripheral(ctx, golog.NewTestLogger(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.StartAdvertising(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SimulateConnect(testCentral); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// write writes a complete value as the test central and commits it.
+func write(t *testing.T, m *MemoryBLEPeripheral, component uint16, value string) {
+	t.Helper()
+	if err := m.SimulateWrite(testCentral, component, 0, []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+	m.FlushWrites()
+}
+
+func publishedRejection(t *testing.T, m *MemoryBLEPeripheral) WriteRejection {
+	t.Helper()
+	var rejection WriteRejection
+	if err := json.Unmarshal(m.wp.rejections.handle.currentValue(), &rejection); err != nil {
+		t.Fatal(err)
+	}
+	return rejection
+}
+
+func TestResetSessionFromEveryState(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		path []ProvisioningState
+	}{
+		{"waiting", nil},
+		{"credentials received", []ProvisioningState{StateCredentialsReceived}},
+		{"scanning", []ProvisioningState{StateCredentialsReceived, StateScanning}},
+		{"connecting", []ProvisioningState{StateCredentialsReceived, StateScanning, StateConnecting}},
+		{"connected", []ProvisioningState{StateCredentialsReceived, StateConnecting, StateConnected}},
+		{"failed", []ProvisioningState{StateCredentialsReceived, StateConnecting, StateFailed}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m := newTestPeripheral(ctx, t)
+
+			write(t, m, SsidUUIDComponent, "wrong")
+			write(t, m, PskUUIDComponent, "short")
+			if rejection := publishedRejection(t, m); rejection.Characteristic != PskCharacteristic {
+				t.Fatalf("published %+v, want a rejection for %s", rejection, PskCharacteristic)
+			}
+			for _, state := range tc.path {
+				status := &ProvisioningStatus{State: state}
+				if state == StateFailed {
+					status.Reason = "wrong password"
+				}
+				if err := m.UpdateStatus(status); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write(t, m, CommandUUIDComponent, string(CommandResetSession))
+			if rejection := publishedRejection(t, m); rejection != (WriteRejection{}) {
+				t.Errorf("published %+v after the session reset, want no rejection", rejection)
+			}
+			var errBLECharNoValue *ErrBLECharNoValue
+			if _, err := Read[string](m, SsidCharacteristic); !errors.As(err, &errBLECharNoValue) {
+				t.Errorf("reading the SSID after the session reset returned %v, want no value", err)
+			}
+			if state := m.status.currentStatus().State; state != StateWaiting {
+				t.Errorf("status is %s after the session reset, want %s", state, StateWaiting)
+			}
+		})
+	}
+}
+
+func TestCentralsTrackedAcrossAdvertising(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newTestPeripheral(ctx, t)
+	events := m.SubscribeConnectionEvents(ctx)
+
+	if err := m.StopAdvertising(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SimulateDisconnect(testCentral); err != nil {
+		t.Fatal(err)
+	}
+	if connected := m.ConnectedCentrals(); len(connected) != 0 {
+		t.Fatalf("connected centrals after disconnecting = %+v", connected)
+	}
+	if err := m.StartAdvertising(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SimulateConnect(testCentral); err != nil {
+		t.Fatal(err)
+	}
+	if connected := m.ConnectedCentrals(); len(connected) != 1 || connected[0].Address != testCentral {
+		t.Fatalf("connected centrals after reconnecting = %+v", connected)
+	}
+
+	for _, want := range []ConnectionEventType{EventDisconnected, EventConnected} {
+		if event := <-events; event.Type != want {
+			t.Errorf("got %s event, want %s", event.Type, want)
+		}
+	}
+}
+
+func TestAuthenticationResetOnLastDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secret := []byte("label secret")
+	m := newTestPeripheral(ctx, t, WithProofOfPossession(secret))
+	// A subscriber which never reads falls behind and has events dropped, which must not matter.
+	_ = m.SubscribeConnectionEvents(ctx)
+
+	challenge, err := m.SimulateRead(testCentral, PoPChallengeUUIDComponent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	write(t, m, PoPResponseUUIDComponent, string(mac.Sum(nil)))
+	if !m.wp.pop.isVerified() {
+		t.Fatal("proof of possession was not verified")
+	}
+
+	// Other centrals coming and going fill the subscriber's buffer without ending the session.
+	const other = "AC:DE:48:00:11:33"
+	for i := 0; i < connectionEventBuffer; i++ {
+		if err := m.SimulateConnect(other); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SimulateDisconnect(other); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !m.wp.pop.isVerified() {
+		t.Fatal("proof of possession was reset while a central was still connected")
+	}
+	if err := m.SimulateDisconnect(testCentral); err != nil {
+		t.Fatal(err)
+	}
+	if m.wp.pop.isVerified() {
+		t.Error("proof of possession is still verified after the last central disconnected")
+	}
+}
+
+func TestEncodingResetOnLastDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newTestPeripheral(ctx, t)
+
+	write(t, m, EncodingSelectionUUIDComponent, string([]byte{byte(EncodingProtobuf)}))
+	encoding, err := m.SimulateRead(testCentral, EncodingUUIDComponent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Encoding(encoding[0]) != EncodingProtobuf {
+		t.Fatalf("encoding is %s after selecting %s", Encoding(encoding[0]), EncodingProtobuf)
+	}
+
+	if err := m.SimulateDisconnect(testCentral); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SimulateConnect(testCentral); err != nil {
+		t.Fatal(err)
+	}
+	if encoding, err = m.SimulateRead(testCentral, EncodingUUIDComponent); err != nil {
+		t.Fatal(err)
+	}
+	if Encoding(encoding[0]) != EncodingJSON {
+		t.Errorf("encoding is %s for the next client, want %s", Encoding(encoding[0]), EncodingJSON)
+	}
+	status, err := m.SimulateRead(testCentral, StatusUUIDComponent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(status, &ProvisioningStatus{}); err != nil {
+		t.Errorf("status is not JSON for the next client: %v", err)
+	}
+}
+
+func TestStatusReasonTruncated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newTestPeripheral(ctx, t)
+
+	reason := "failed to connect to Wi-Fi: " + strings.Repeat("NetworkManager error ", 20)
+	if err := m.UpdateStatus(&ProvisioningStatus{State: StateFailed, Reason: reason}); err != nil {
+		t.Fatal(err)
+	}
+	value, err := m.SimulateRead(testCentral, StatusUUIDComponent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status ProvisioningStatus
+	if err := json.Unmarshal(value, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Reason != truncateReason(reason) || len(status.Reason) > maxReasonLength {
+		t.Errorf("published reason %q, want it truncated to %d bytes", status.Reason, maxReasonLength)
+	}
+}
@@ -0,0 +1,123 @@
+package bleperipheral
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ProvisioningState is a step of the provisioning process, as reported to clients over the status characteristic.
+type ProvisioningState string
+
+const (
+	StateWaiting             ProvisioningState = "waiting"
+	StateCredentialsReceived ProvisioningState = "credentials_received"
+	StateScanning            ProvisioningState = "scanning"
+	StateConnecting          ProvisioningState = "connecting"
+	StateConnected           ProvisioningState = "connected"
+	StateFailed              ProvisioningState = "failed"
+)
+
+// validTransitions lists the states reachable from each state. Every state may return to StateWaiting, as clients may
+// reset the session at any time (see CommandResetSession). Failures may be retried from the start or with the
+// credentials already received.
+var validTransitions = map[ProvisioningState][]ProvisioningState{
+	StateWaiting:             {StateCredentialsReceived, StateFailed},
+	StateCredentialsReceived: {StateWaiting, StateScanning, StateConnecting, StateFailed},
+	StateScanning:            {StateWaiting, StateConnecting, StateFailed},
+	StateConnecting:          {StateWaiting, StateConnected, StateFailed},
+	StateConnected:           {StateWaiting},
+	StateFailed:              {StateWaiting, StateCredentialsReceived, StateScanning, StateConnecting},
+}
+
+// ProvisioningStatus is the payload of the status characteristic.
+type ProvisioningStatus struct {
+	State  ProvisioningState `json:"state"`
+	Reason string            `json:"reason,omitempty"` // Only set when State is StateFailed.
+}
+
+func (ps *ProvisioningStatus) ToBytes() ([]byte, error) {
+	return json.Marshal(ps)
+}
+
+// statusMachine tracks the provisioning state and publishes every transition to the status characteristic, whose
+// subscribers are notified of the new value.
+type statusMachine struct {
+	mu       *sync.Mutex
+	current  ProvisioningStatus
+	encoding Encoding
+	handle   *characteristicHandle
+}
+
+func newStatusMachine() (*statusMachine, error) {
+	current := ProvisioningStatus{State: StateWaiting}
+	bs, err := current.ToBytes()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to cast provisioning status to bytes")
+	}
+	return &statusMachine{
+		mu:       &sync.Mutex{},
+		current:  current,
+		encoding: EncodingJSON,
+		handle:   newCharacteristicHandle(bs),
+	}, nil
+}
+
+// currentStatus returns the current provisioning status.
+func (sm *statusMachine) currentStatus() ProvisioningStatus {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.current
+}
+
+// transition moves to the given status if it is reachable from the current state. The reason is truncated to
+// maxReasonLength.
+func (sm *statusMachine) transition(status *ProvisioningStatus) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if status.State != StateFailed && status.Reason != "" {
+		return errors.Errorf("a reason may only be given for state %q", StateFailed)
+	}
+	status = &ProvisioningStatus{State: status.State, Reason: truncateReason(status.Reason)}
+	if status.State != sm.current.State {
+		reachable := false
+		for _, state := range validTransitions[sm.current.State] {
+			if state == status.State {
+				reachable = true
+				break
+			}
+		}
+		if !reachable {
+			return errors.Errorf("invalid provisioning state transition from %q to %q", sm.current.State, status.State)
+		}
+	}
+	if err := sm.publishLocked(status, sm.encoding); err != nil {
+		return err
+	}
+	sm.current = *status
+	return nil
+}
+
+// setEncoding re-publishes the current status in the given encoding.
+func (sm *statusMachine) setEncoding(encoding Encoding) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if err := sm.publishLocked(&sm.current, encoding); err != nil {
+		return err
+	}
+	sm.encoding = encoding
+	return nil
+}
+
+func (sm *statusMachine) publishLocked(status *ProvisioningStatus, encoding Encoding) error {
+	bs, err := encoding.encode(status)
+	if err != nil {
+		return errors.WithMessage(err, "failed to cast provisioning status to bytes")
+	}
+	if _, err := sm.handle.Write(bs); err != nil {
+		return errors.WithMessage(err, "failed to write provisioning status to bluetooth characteristic")
+	}
+	return nil
+}
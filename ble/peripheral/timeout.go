@@ -0,0 +1,60 @@
+package bleperipheral
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrAdvertisingTimeout is the cause of advertising stopping once the advertising window set with
+// WithAdvertisingTimeout elapses.
+var ErrAdvertisingTimeout = errors.New("advertising window elapsed")
+
+// advertisingWindow stops advertising once a fixed duration has passed since advertising started, to limit the attack
+// surface and power draw of a device left unprovisioned.
+type advertisingWindow struct {
+	timeout time.Duration // Zero if advertising is not limited.
+
+	mu      *sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newAdvertisingWindow(timeout time.Duration) *advertisingWindow {
+	return &advertisingWindow{timeout: timeout, mu: &sync.Mutex{}}
+}
+
+// open starts a new window, at the end of which onExpire is called before the window's channel is closed.
+func (w *advertisingWindow) open(onExpire func()) {
+	if w.timeout <= 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	expired := make(chan struct{})
+	w.expired = expired
+	w.timer = time.AfterFunc(w.timeout, func() {
+		onExpire()
+		close(expired)
+	})
+}
+
+// close ends the current window early, e.g. because advertising was stopped.
+func (w *advertisingWindow) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// done returns a channel which is closed once the current window elapses, or nil if advertising is not limited.
+func (w *advertisingWindow) done() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.expired
+}
@@ -0,0 +1,185 @@
+package bleperipheral
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/edaniels/golog"
+	"github.com/godbus/dbus"
+	"github.com/pkg/errors"
+)
+
+// TrustPolicy decides which centrals are paired with and marked as trusted by BlueZ, and for how long.
+type TrustPolicy interface {
+	// CanTrust returns an error if the central with the given MAC address may not be trusted, given the addresses of the
+	// centrals trusted so far.
+	CanTrust(address string, trusted []string) error
+	// SessionOnly returns whether trust is revoked, and centrals are removed from BlueZ, once provisioning completes or,
+	// for centrals no longer connected, advertising stops.
+	SessionOnly() bool
+}
+
+// AddressTrustPolicy is a TrustPolicy based on the addresses of centrals. Allowlist and Denylist entries are full MAC
+// addresses (e.g. "AC:DE:48:00:11:22") or OUI prefixes, i.e. their first three octets (e.g. "AC:DE:48").
+type AddressTrustPolicy struct {
+	Allowlist         []string // If empty, every central not on the Denylist is allowed.
+	Denylist          []string
+	MaxTrustedDevices int // If zero, any number of centrals may be trusted at once.
+	Permanent         bool
+}
+
+// CanTrust implements TrustPolicy.
+func (p *AddressTrustPolicy) CanTrust(address string, trusted []string) error {
+	if matchesAddress(p.Denylist, address) {
+		return errors.Errorf("central %s is denylisted", address)
+	}
+	if len(p.Allowlist) > 0 && !matchesAddress(p.Allowlist, address) {
+		return errors.Errorf("central %s is not allowlisted", address)
+	}
+	for _, t := range trusted {
+		if strings.EqualFold(t, address) {
+			return nil
+		}
+	}
+	if p.MaxTrustedDevices > 0 && len(trusted) >= p.MaxTrustedDevices {
+		return errors.Errorf("cannot trust central %s, %d centrals are already trusted", address, len(trusted))
+	}
+	return nil
+}
+
+// SessionOnly implements TrustPolicy.
+func (p *AddressTrustPolicy) SessionOnly() bool {
+	return !p.Permanent
+}
+
+// matchesAddress returns whether address equals, or is within the OUI of, any of the given entries.
+func matchesAddress(entries []string, address string) bool {
+	address = strings.ToUpper(address)
+	for _, entry := range entries {
+		entry = strings.ToUpper(entry)
+		if address == entry || strings.HasPrefix(address, entry+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// trustManager applies a TrustPolicy to centrals and keeps track of those it trusted, so that their trust can be
+// revoked again.
+type trustManager struct {
+	logger      golog.Logger
+	policy      TrustPolicy
+	adapterPath dbus.ObjectPath
+
+	mu      *sync.Mutex
+	trusted map[string]dbus.ObjectPath // Device object paths by address.
+}
+
+func newTrustManager(logger golog.Logger, policy TrustPolicy, adapterPath dbus.ObjectPath) *trustManager {
+	if policy == nil {
+		policy = &AddressTrustPolicy{}
+	}
+	return &trustManager{
+		logger:      logger,
+		policy:      policy,
+		adapterPath: adapterPath,
+		mu:          &sync.Mutex{},
+		trusted:     map[string]dbus.ObjectPath{},
+	}
+}
+
+// canTrust returns an error if the policy does not allow the central with the given address to be trusted.
+func (tm *trustManager) canTrust(address string) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.canTrustLocked(address)
+}
+
+func (tm *trustManager) canTrustLocked(address string) error {
+	trusted := make([]string, 0, len(tm.trusted))
+	for t := range tm.trusted {
+		trusted = append(trusted, t)
+	}
+	return tm.policy.CanTrust(address, trusted)
+}
+
+// trust marks the device at the given object path as trusted if the policy allows it, or disconnects it otherwise.
+func (tm *trustManager) trust(devicePath dbus.ObjectPath) error {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	address := convertDBusPathToMAC(string(devicePath))
+	if err := tm.canTrustLocked(address); err != nil {
+		tm.logger.Warnw("refusing to trust central, disconnecting", "device", address, "reason", err)
+		return disconnectDevice(devicePath)
+	}
+	if err := setDeviceTrusted(devicePath, true); err != nil {
+		return err
+	}
+	tm.trusted[strings.ToUpper(address)] = devicePath
+	tm.logger.Infow("device marked as trusted", "device", address)
+	return nil
+}
+
+// revokeSessionTrust untrusts and removes from BlueZ every central trusted so far, except those with the given
+// addresses, if the policy only grants trust for the provisioning session. Removing a central disconnects it, so
+// centrals still waiting for status notifications are kept, to be revoked once provisioning completes.
+func (tm *trustManager) revokeSessionTrust(keep ...string) error {
+	if !tm.policy.SessionOnly() {
+		return nil
+	}
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return errors.WithMessage(err, "failed to connect to system DBus")
+	}
+	var errs []string
+	for address, devicePath := range tm.trusted {
+		if matchesAddress(keep, address) {
+			tm.logger.Infow("keeping trust of connected device until provisioning completes", "device", address)
+			continue
+		}
+		if err := setDeviceTrusted(devicePath, false); err != nil {
+			errs = append(errs, err.Error())
+		}
+		call := conn.Object(BluezDBusService, tm.adapterPath).Call(BluezAdapter+".RemoveDevice", 0, devicePath)
+		if call.Err != nil {
+			errs = append(errs, errors.WithMessagef(call.Err, "failed to remove device %s", address).Error())
+			continue
+		}
+		delete(tm.trusted, address)
+		tm.logger.Infow("revoked trust and removed device", "device", address)
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("failed to revoke trust of centrals: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// setDeviceTrusted sets the Trusted property of the device at the given object path.
+func setDeviceTrusted(devicePath dbus.ObjectPath, trusted bool) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return errors.WithMessage(err, "failed to connect to system DBus")
+	}
+	call := conn.Object(BluezDBusService, devicePath).Call("org.freedesktop.DBus.Properties.Set", 0,
+		BluezDevice, "Trusted", dbus.MakeVariant(trusted))
+	if call.Err != nil {
+		return errors.WithMessage(call.Err, "failed to set Trusted property")
+	}
+	return nil
+}
+
+// disconnectDevice disconnects the device at the given object path.
+func disconnectDevice(devicePath dbus.ObjectPath) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return errors.WithMessage(err, "failed to connect to system DBus")
+	}
+	if call := conn.Object(BluezDBusService, devicePath).Call(BluezDevice+".Disconnect", 0); call.Err != nil {
+		return errors.WithMessage(call.Err, "failed to disconnect device")
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package bleperipheral
+
+import "testing"
+
+func TestMatchesAddress(t *testing.T) {
+	entries := []string{"AC:DE:48", "00:1a:7d:da:71:13"}
+	for _, tc := range []struct {
+		address string
+		want    bool
+	}{
+		{"AC:DE:48:00:11:22", true},
+		{"ac:de:48:ff:ff:ff", true},
+		{"00:1A:7D:DA:71:13", true},
+		{"00:1A:7D:DA:71:14", false},
+		{"AC:DE:49:00:11:22", false},
+		{"AC:DE:4", false},
+		{"", false},
+	} {
+		if got := matchesAddress(entries, tc.address); got != tc.want {
+			t.Errorf("matchesAddress(%q) = %t, want %t", tc.address, got, tc.want)
+		}
+	}
+	if matchesAddress(nil, "AC:DE:48:00:11:22") {
+		t.Error("matchesAddress with no entries matched")
+	}
+}
+
+func TestAddressTrustPolicyCanTrust(t *testing.T) {
+	policy := &AddressTrustPolicy{
+		Allowlist:         []string{"AC:DE:48"},
+		Denylist:          []string{"AC:DE:48:00:00:01"},
+		MaxTrustedDevices: 1,
+	}
+	for _, tc := range []struct {
+		address string
+		trusted []string
+		ok      bool
+	}{
+		{"AC:DE:48:00:11:22", nil, true},
+		{"AC:DE:48:00:00:01", nil, false},
+		{"00:1A:7D:DA:71:13", nil, false},
+		{"AC:DE:48:00:11:22", []string{"ac:de:48:00:11:22"}, true},
+		{"AC:DE:48:00:11:23", []string{"AC:DE:48:00:11:22"}, false},
+	} {
+		if err := policy.CanTrust(tc.address, tc.trusted); (err == nil) != tc.ok {
+			t.Errorf("CanTrust(%q, %q) = %v, want ok %t", tc.address, tc.trusted, err, tc.ok)
+		}
+	}
+}
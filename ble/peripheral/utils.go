@@ -1,16 +1,18 @@
 package bleperipheral
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"os/exec"
+	"net"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/edaniels/golog"
 	"github.com/godbus/dbus"
 	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+	"go.viam.com/utils"
 )
 
 const (
@@ -18,6 +20,7 @@ const (
 	BluezAgentPath    = "/custom/agent"
 	BluezAgentManager = "org.bluez.AgentManager1"
 	BluezAgent        = "org.bluez.Agent1"
+	BluezDevice       = "org.bluez.Device1"
 )
 
 // checkOS verifies the system is running a Linux distribution
@@ -28,177 +31,234 @@ func checkOS() error {
 	return nil
 }
 
-// getBlueZVersion retrieves the installed BlueZ version and extracts the numeric value correctly
-func getBlueZVersion() (float64, error) {
-	// Try to get version from bluetoothctl first, fallback to bluetoothd
-	versionCmds := []string{"bluetoothctl --version", "bluetoothd --version"}
-
-	var versionOutput bytes.Buffer
-	var err error
-
-	for _, cmd := range versionCmds {
-		versionOutput.Reset() // Clear buffer
-		cmdParts := strings.Fields(cmd)
-		execCmd := exec.Command(cmdParts[0], cmdParts[1:]...)
-		execCmd.Stdout = &versionOutput
-		err = execCmd.Run()
-		if err == nil {
-			break // Found a valid command
-		}
+// validateSystem checks the BlueZ installation/version and the capabilities of the given adapter
+func validateSystem(logger golog.Logger, adapter *adapterInfo) (*BlueZCapabilities, error) {
+	// 1. Probe BlueZ
+	caps, err := probeBlueZ(adapter)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("✅ BlueZ detected, version: %s (from %s)", caps.Version, caps.VersionSource)
+	logger.Infow("BlueZ capabilities",
+		"adapter", caps.Adapter,
+		"le_advertising_manager", caps.LEAdvertisingManager,
+		"gatt_manager", caps.GattManager,
+		"advertising_instances", caps.AdvertisingInstances,
+		"experimental_features", caps.ExperimentalFeatures)
+
+	// 2. Validate BlueZ version and capabilities
+	if err := caps.check(); err != nil {
+		return caps, fmt.Errorf("❌ %w", err)
 	}
 
+	logger.Infof("✅ BlueZ meets the requirements (%s or later, LE advertising and GATT support).", MinBlueZVersion)
+	return caps, nil
+}
+
+const propertiesChangedMatchRule = "type='signal',interface='org.freedesktop.DBus.Properties',member='PropertiesChanged'"
+
+// connectionListener is the D-Bus subscription through which devices are tracked as they connect, pair and disconnect
+// through the adapter. It lives for as long as the peripheral, so that centrals disconnecting while not advertising are
+// still noticed, whereas the pairing agent is only registered while advertising.
+type connectionListener struct {
+	logger   golog.Logger
+	conn     *dbus.Conn
+	agent    *pairingAgent
+	centrals *centralTracker
+	signals  chan *dbus.Signal // Owned by the connection, which closes it if terminated.
+	stopping chan struct{}
+	stopOnce *sync.Once
+	done     chan struct{}
+}
+
+// startConnectionListener records connection events of devices connecting through the adapter in centrals, trusting
+// them as they connect if the trust policy allows it, until ctx is done.
+func startConnectionListener(
+	ctx context.Context, logger golog.Logger, agent *pairingAgent, centrals *centralTracker,
+) (*connectionListener, error) {
+	conn, err := dbus.SystemBus()
 	if err != nil {
-		return 0, fmt.Errorf("BlueZ is not installed or not accessible")
+		return nil, errors.WithMessage(err, "failed to connect to system DBus")
+	}
+
+	// Add a match rule to listen for DBus property changes
+	if err := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, propertiesChangedMatchRule).Err; err != nil {
+		return nil, errors.WithMessage(err, "failed to add DBus match rule")
 	}
 
-	// Extract only the numeric version
-	versionStr := strings.TrimSpace(versionOutput.String())
-	parts := strings.Fields(versionStr)
+	// Listen for properties changed events
+	cl := newConnectionListener(logger, agent, centrals)
+	cl.conn = conn
+	conn.Signal(cl.signals)
+	utils.ManagedGo(cl.listen, nil)
+	context.AfterFunc(ctx, func() {
+		if err := cl.stop(); err != nil {
+			logger.Warnw("failed to stop listening for connection events", "err", err)
+		}
+	})
+	return cl, nil
+}
 
-	// Ensure we have at least one part before accessing it
-	if len(parts) == 0 {
-		return 0, fmt.Errorf("failed to parse BlueZ version: empty output")
+func newConnectionListener(logger golog.Logger, agent *pairingAgent, centrals *centralTracker) *connectionListener {
+	return &connectionListener{
+		logger:   logger,
+		agent:    agent,
+		centrals: centrals,
+		signals:  make(chan *dbus.Signal, 10),
+		stopping: make(chan struct{}),
+		stopOnce: &sync.Once{},
+		done:     make(chan struct{}),
 	}
+}
 
-	versionNum := parts[len(parts)-1] // Get the last word, which should be the version number
+// listen handles signals until stopped or the connection is terminated.
+func (cl *connectionListener) listen() {
+	defer close(cl.done)
+
+	for {
+		select {
+		case <-cl.stopping:
+			return
+		case signal, ok := <-cl.signals:
+			if !ok {
+				return
+			}
+			cl.handleSignal(signal)
+		}
+	}
+}
 
-	// Convert to float
-	versionFloat, err := strconv.ParseFloat(versionNum, 64)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse BlueZ version: %s", versionStr)
+// handleSignal tracks devices as they connect, pair and disconnect, and trusts them as they connect.
+func (cl *connectionListener) handleSignal(signal *dbus.Signal) {
+	// Check if the signal is from a BlueZ device
+	if len(signal.Body) < 3 {
+		return
+	}
+
+	iface, ok := signal.Body[0].(string)
+	if !ok || iface != BluezDevice {
+		return
+	}
+
+	// Only devices connecting through our adapter are of interest
+	devicePath := string(signal.Path)
+	if !strings.HasPrefix(devicePath, string(cl.agent.trust.adapterPath)+"/") {
+		return
+	}
+
+	// Convert DBus object path to MAC address
+	deviceMAC := convertDBusPathToMAC(devicePath)
+	if deviceMAC == "" {
+		return
+	}
+
+	changedProps, ok := signal.Body[1].(map[string]dbus.Variant)
+	if !ok {
+		return
 	}
 
-	return versionFloat, nil
+	// Connected is handled first, as it may change in the same signal as Paired and the central is only tracked once
+	// connected.
+	if connected, exists := changedProps["Connected"]; exists {
+		if !cl.handleConnected(dbus.ObjectPath(devicePath), deviceMAC, connected.Value() == true) {
+			return
+		}
+	}
+	if paired, exists := changedProps["Paired"]; exists && paired.Value() == true {
+		cl.centrals.paired(deviceMAC)
+	}
 }
 
-// validateSystem checks OS and BlueZ installation/version
-func validateSystem(logger golog.Logger) error {
-	// 1. Validate OS
-	if err := checkOS(); err != nil {
-		return err
+// handleConnected records a device connecting or disconnecting, trusting it as it connects. It returns false if the
+// device was refused.
+func (cl *connectionListener) handleConnected(devicePath dbus.ObjectPath, deviceMAC string, connected bool) bool {
+	if !connected {
+		cl.centrals.disconnected(deviceMAC)
+		return true
 	}
-	logger.Info("✅ Running on a Linux system.")
 
-	// 2. Check BlueZ version
-	blueZVersion, err := getBlueZVersion()
-	if err != nil {
-		return err
+	// TODO [APP-7613]: Pairing attempts from an iPhone connect first
+	// before pairing, so listen for a "Connected" event on the system
+	// D-Bus. This should be tested against Android.
+	if err := cl.agent.limiter.checkLockout(deviceMAC); err != nil {
+		cl.logger.Warnw("refusing connection, disconnecting", "device", deviceMAC, "reason", err)
+		if err := disconnectDevice(devicePath); err != nil {
+			cl.logger.Errorw("failed to disconnect device", "device", deviceMAC, "err", err)
+		}
+		return false
 	}
-	logger.Infof("✅ BlueZ detected, version: %.2f", blueZVersion)
+	cl.centrals.connected(deviceMAC)
+
+	cl.logger.Infof("device %s initiated pairing!", deviceMAC)
 
-	// 3. Validate BlueZ version is 5.66 or higher
-	if blueZVersion < 5.66 {
-		return fmt.Errorf("❌ BlueZ version is %.2f, but 5.66 or later is required", blueZVersion)
+	// Mark device as trusted
+	if err := cl.agent.trust.trust(devicePath); err != nil {
+		cl.logger.Errorw("failed to trust device", "device", deviceMAC, "err", err)
 	}
+	return true
+}
+
+// stop unsubscribes from D-Bus signals and waits for the listening goroutine to exit.
+func (cl *connectionListener) stop() error {
+	// The signal channel is never closed here, as the connection closes it if terminated, possibly concurrently.
+	cl.conn.RemoveSignal(cl.signals)
+	cl.stopOnce.Do(func() { close(cl.stopping) })
+	<-cl.done
 
-	logger.Info("✅ BlueZ version meets the requirement (5.66 or later).")
+	if err := cl.conn.BusObject().Call("org.freedesktop.DBus.RemoveMatch", 0, propertiesChangedMatchRule).Err; err != nil {
+		return errors.WithMessage(err, "failed to remove DBus match rule")
+	}
 	return nil
 }
 
-// listenForPairing waits for an incoming BLE pairing request and automatically trusts the device.
-func listenForPairing(logger golog.Logger) error {
+// registerAgent exports the pairing agent and registers it with BlueZ as the default agent with the given capability,
+// so that it answers incoming BLE pairing requests until unregistered.
+func registerAgent(logger golog.Logger, agent *pairingAgent, capability AgentCapability) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		return errors.WithMessage(err, "failed to connect to system DBus")
 	}
 
 	// Export agent methods
-	reply := conn.Export(nil, BluezAgentPath, BluezAgent)
+	reply := conn.Export(agent, BluezAgentPath, BluezAgent)
 	if reply != nil {
 		return errors.WithMessage(reply, "failed to export Bluez agent")
 	}
 
 	// Register the agent
 	obj := conn.Object(BluezDBusService, "/org/bluez")
-	call := obj.Call("org.bluez.AgentManager1.RegisterAgent", 0, dbus.ObjectPath(BluezAgentPath), "NoInputNoOutput")
+	call := obj.Call(BluezAgentManager+".RegisterAgent", 0, dbus.ObjectPath(BluezAgentPath), string(capability))
 	if err := call.Err; err != nil {
+		_ = conn.Export(nil, BluezAgentPath, BluezAgent)
 		return errors.WithMessage(err, "failed to register Bluez agent")
 	}
 
 	// Set as the default agent
-	call = obj.Call("org.bluez.AgentManager1.RequestDefaultAgent", 0, dbus.ObjectPath(BluezAgentPath))
+	call = obj.Call(BluezAgentManager+".RequestDefaultAgent", 0, dbus.ObjectPath(BluezAgentPath))
 	if err := call.Err; err != nil {
-		return errors.WithMessage(err, "failed to set default Bluez agent")
-	}
-
-	logger.Info("Bluez agent registered!")
-
-	// Listen for properties changed events
-	signalChan := make(chan *dbus.Signal, 10)
-	conn.Signal(signalChan)
-
-	// Add a match rule to listen for DBus property changes
-	matchRule := "type='signal',interface='org.freedesktop.DBus.Properties',member='PropertiesChanged'"
-	err = conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0, matchRule).Err
-	if err != nil {
-		return errors.WithMessage(err, "failed to add DBus match rule")
+		return multierr.Combine(errors.WithMessage(err, "failed to set default Bluez agent"), unregisterAgent(logger))
 	}
 
+	logger.Infof("Bluez agent registered with capability %s!", capability)
 	logger.Info("waiting for a BLE pairing request...")
-
-	for signal := range signalChan {
-		// Check if the signal is from a BlueZ device
-		if len(signal.Body) < 3 {
-			continue
-		}
-
-		iface, ok := signal.Body[0].(string)
-		if !ok || iface != "org.bluez.Device1" {
-			continue
-		}
-
-		// Check if the "Paired" property is in the event
-		changedProps, ok := signal.Body[1].(map[string]dbus.Variant)
-		if !ok {
-			continue
-		}
-
-		// TODO [APP-7613]: Pairing attempts from an iPhone connect first
-		// before pairing, so listen for a "Connected" event on the system
-		// D-Bus. This should be tested against Android.
-		connected, exists := changedProps["Connected"]
-		if !exists || connected.Value() != true {
-			continue
-		}
-
-		// Extract device path from the signal sender
-		devicePath := string(signal.Path)
-
-		// Convert DBus object path to MAC address
-		deviceMAC := convertDBusPathToMAC(devicePath)
-		if deviceMAC == "" {
-			continue
-		}
-
-		logger.Infof("device %s initiated pairing!", deviceMAC)
-
-		// Mark device as trusted
-		if err = trustDevice(logger, devicePath); err != nil {
-			return errors.WithMessage(err, "failed to trust device")
-		} else {
-			logger.Info("device successfully trusted!")
-		}
-	}
 	return nil
 }
 
-// trustDevice sets the device as trusted and connects to it
-func trustDevice(logger golog.Logger, devicePath string) error {
+// unregisterAgent unregisters the agent from BlueZ and stops serving its methods.
+func unregisterAgent(logger golog.Logger) error {
 	conn, err := dbus.SystemBus()
 	if err != nil {
-		return fmt.Errorf("failed to connect to DBus: %w", err)
+		return errors.WithMessage(err, "failed to connect to system DBus")
 	}
-
-	obj := conn.Object(BluezDBusService, dbus.ObjectPath(devicePath))
-
-	// Set Trusted = true
-	call := obj.Call("org.freedesktop.DBus.Properties.Set", 0,
-		"org.bluez.Device1", "Trusted", dbus.MakeVariant(true))
-	if call.Err != nil {
-		return fmt.Errorf("failed to set Trusted property: %w", call.Err)
+	obj := conn.Object(BluezDBusService, "/org/bluez")
+	err = obj.Call(BluezAgentManager+".UnregisterAgent", 0, dbus.ObjectPath(BluezAgentPath)).Err
+	if exportErr := conn.Export(nil, BluezAgentPath, BluezAgent); err == nil && exportErr != nil {
+		err = exportErr
 	}
-	logger.Info("device marked as trusted.")
-
+	if err != nil {
+		return errors.WithMessage(err, "failed to unregister Bluez agent")
+	}
+	logger.Info("Bluez agent unregistered")
 	return nil
 }
 
@@ -209,8 +269,20 @@ func convertDBusPathToMAC(path string) string {
 		return ""
 	}
 
-	// Extract last part and convert underscores to colons
-	macPart := parts[len(parts)-1]
+	// Extract last part, e.g. dev_AC_DE_48_00_11_22, and convert underscores to colons
+	macPart, ok := strings.CutPrefix(parts[len(parts)-1], "dev_")
+	if !ok {
+		return ""
+	}
 	mac := strings.ReplaceAll(macPart, "_", ":")
 	return mac
 }
+
+// deviceObjectPath returns the DBus object path of the device with the given Bluetooth MAC address under an adapter.
+func deviceObjectPath(adapterPath dbus.ObjectPath, mac string) (dbus.ObjectPath, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return "", errors.Errorf("%q is not a Bluetooth MAC address", mac)
+	}
+	return dbus.ObjectPath(string(adapterPath) + "/dev_" + strings.ReplaceAll(strings.ToUpper(hw.String()), ":", "_")), nil
+}
@@ -0,0 +1,87 @@
+package bleperipheral
+
+import (
+	"context"
+	"testing"
+
+	"github.com/edaniels/golog"
+	"github.com/godbus/dbus"
+)
+
+func TestConvertDBusPathToMAC(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/org/bluez/hci0/dev_AC_DE_48_00_11_22", "AC:DE:48:00:11:22"},
+		{"/org/bluez/hci1/dev_00_1A_7D_DA_71_13", "00:1A:7D:DA:71:13"},
+		{"/org/bluez/hci0", ""},
+		{"/org/bluez/hci0/dev_AC_DE_48_00_11_22/service0001", ""},
+		{"dev_AC_DE_48_00_11_22", ""},
+		{"", ""},
+	} {
+		if got := convertDBusPathToMAC(tc.path); got != tc.want {
+			t.Errorf("convertDBusPathToMAC(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestDeviceObjectPath(t *testing.T) {
+	adapterPath := dbus.ObjectPath("/org/bluez/hci0")
+	for _, mac := range []string{"AC:DE:48:00:11:22", "ac:de:48:00:11:22"} {
+		path, err := deviceObjectPath(adapterPath, mac)
+		if err != nil {
+			t.Fatalf("deviceObjectPath(%q) failed: %v", mac, err)
+		}
+		if want := dbus.ObjectPath("/org/bluez/hci0/dev_AC_DE_48_00_11_22"); path != want {
+			t.Errorf("deviceObjectPath(%q) = %q, want %q", mac, path, want)
+		}
+		if got := convertDBusPathToMAC(string(path)); got != "AC:DE:48:00:11:22" {
+			t.Errorf("convertDBusPathToMAC(deviceObjectPath(%q)) = %q", mac, got)
+		}
+	}
+	for _, mac := range []string{"", "dev:AC:DE:48:00:11:22", "AC:DE:48:00:11", "00:00:00:00:fe:80:00:00"} {
+		if path, err := deviceObjectPath(adapterPath, mac); err == nil {
+			t.Errorf("deviceObjectPath(%q) = %q, want an error", mac, path)
+		}
+	}
+}
+
+// TestConnectionListenerAcrossAdvertising checks that centrals are tracked regardless of advertising, which only
+// registers and unregisters the pairing agent: a central disconnecting after advertising stopped is forgotten, and
+// reconnecting once advertising starts again is reported as a new connection.
+func TestConnectionListenerAcrossAdvertising(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := golog.NewTestLogger(t)
+	centrals := newCentralTracker(logger)
+	limiter := newRateLimiter(logger, nil, centrals)
+	agent := newPairingAgent(logger, nil, newTrustManager(logger, nil, "/org/bluez/hci0"), limiter)
+	cl := newConnectionListener(logger, agent, centrals)
+	events := centrals.subscribe(ctx)
+	setConnected := func(connected bool) {
+		cl.handleSignal(&dbus.Signal{
+			Path: "/org/bluez/hci0/dev_AC_DE_48_00_11_22",
+			Body: []interface{}{BluezDevice, map[string]dbus.Variant{"Connected": dbus.MakeVariant(connected)}, []string{}},
+		})
+	}
+
+	setConnected(true)
+	// Advertising stops, then the central disconnects.
+	setConnected(false)
+	if connected := centrals.connectedCentrals(); len(connected) != 0 {
+		t.Fatalf("connected centrals after disconnecting = %+v", connected)
+	}
+	// Advertising starts again, then the central reconnects.
+	setConnected(true)
+	if connected := centrals.connectedCentrals(); len(connected) != 1 {
+		t.Fatalf("connected centrals after reconnecting = %+v", connected)
+	}
+
+	for _, want := range []ConnectionEventType{EventConnected, EventDisconnected, EventConnected} {
+		if event := <-events; event.Type != want {
+			t.Errorf("got %s event, want %s", event.Type, want)
+		}
+	}
+}
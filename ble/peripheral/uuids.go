@@ -0,0 +1,69 @@
+package bleperipheral
+
+import (
+	"github.com/google/uuid"
+	"tinygo.org/x/bluetooth"
+)
+
+// DefaultBaseUUID is the published base UUID from which the provisioning service and all of its characteristics
+// are derived. Clients may filter scans on the service UUID derived from it without any prior knowledge of the device.
+var DefaultBaseUUID = uuid.MustParse("84d30000-13ff-42f5-bf21-be4fa89eff6f")
+
+// Each GATT attribute exposed by the provisioning service is identified by a fixed 16-bit component, which is
+// substituted into bits 96-111 of the base UUID (e.g. 84d3XXXX-13ff-42f5-bf21-be4fa89eff6f).
+const (
+	ServiceUUIDComponent               uint16 = 0x1111
+	SsidUUIDComponent                  uint16 = 0x2222
+	PskUUIDComponent                   uint16 = 0x3333
+	RobotPartKeyIDUUIDComponent        uint16 = 0x4444
+	RobotPartKeyUUIDComponent          uint16 = 0x5555
+	AvailableWiFiNetworksUUIDComponent uint16 = 0x6666
+	DevicePublicKeyUUIDComponent       uint16 = 0x7777
+	ClientPublicKeyUUIDComponent       uint16 = 0x8888
+	PoPChallengeUUIDComponent          uint16 = 0x9999
+	PoPResponseUUIDComponent           uint16 = 0xaaaa
+	StatusUUIDComponent                uint16 = 0xbbbb
+	NetworksPageIndexUUIDComponent     uint16 = 0xcccc
+	WriteRejectionUUIDComponent        uint16 = 0xdddd
+	CommandUUIDComponent               uint16 = 0xeeee
+	EncodingUUIDComponent              uint16 = 0xe001
+	EncodingSelectionUUIDComponent     uint16 = 0xe002
+
+	// Device information, see DeviceInfo.
+	HostnameUUIDComponent           uint16 = 0xd001
+	WiFiMACUUIDComponent            uint16 = 0xd002
+	SerialNumberUUIDComponent       uint16 = 0xd003
+	OSVersionUUIDComponent          uint16 = 0xd004
+	BtprovVersionUUIDComponent      uint16 = 0xd005
+	ViamAgentInstalledUUIDComponent uint16 = 0xd006
+)
+
+// reservedUUIDComponents returns the components of the attributes built into the provisioning service, which
+// characteristics declared with WithWritableCharacteristic or WithReadableCharacteristic may not use.
+func reservedUUIDComponents() map[uint16]string {
+	return map[uint16]string{
+		ServiceUUIDComponent:               "provisioning service",
+		AvailableWiFiNetworksUUIDComponent: "available WiFi networks",
+		DevicePublicKeyUUIDComponent:       "device public key",
+		ClientPublicKeyUUIDComponent:       "client public key",
+		PoPChallengeUUIDComponent:          "proof-of-possession challenge",
+		PoPResponseUUIDComponent:           "proof-of-possession response",
+		StatusUUIDComponent:                "provisioning status",
+		NetworksPageIndexUUIDComponent:     "networks page index",
+		WriteRejectionUUIDComponent:        "write rejection",
+		CommandUUIDComponent:               "command",
+		EncodingUUIDComponent:              "encoding",
+		EncodingSelectionUUIDComponent:     "encoding selection",
+	}
+}
+
+// DeriveUUID returns the UUID of the GATT attribute identified by component under the given base UUID.
+func DeriveUUID(base uuid.UUID, component uint16) bluetooth.UUID {
+	return bluetooth.NewUUID(base).Replace16BitComponent(component)
+}
+
+// BaseUUIDFromSerial returns a base UUID unique to (and stable for) a device serial number. It is a name-based
+// (SHA-1) UUID in the namespace of DefaultBaseUUID, so clients that know the serial can compute it independently.
+func BaseUUIDFromSerial(serial string) uuid.UUID {
+	return uuid.NewSHA1(DefaultBaseUUID, []byte(serial))
+}
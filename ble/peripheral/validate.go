@@ -0,0 +1,175 @@
+package bleperipheral
+
+import (
+	"encoding/json"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxSSIDLength      = 32
+	minPassphraseLen   = 8
+	maxPassphraseLen   = 63
+	hexPSKLength       = 64
+	maxRobotPartKeyLen = 256
+)
+
+// maxReasonLength is the maximum length in bytes of the reasons published with write rejections and provisioning
+// statuses. BlueZ (through tinygo) ignores the offset of long reads, so clients only ever receive what fits in a single
+// ATT read or notification, and a payload with a reason this long still fits at the MTU most commonly negotiated by
+// mobile clients (see defaultNetworksPageSize).
+const maxReasonLength = 100
+
+// Validator checks a value written by a client before it is committed. The error it returns is published to the
+// client as the reason the write was rejected.
+type Validator[T any] func(T) error
+
+// ValidateSSID accepts SSIDs of 1 to 32 bytes.
+func ValidateSSID(ssid string) error {
+	if len(ssid) == 0 || len(ssid) > maxSSIDLength {
+		return errors.Errorf("SSID must be 1 to %d bytes, got %d", maxSSIDLength, len(ssid))
+	}
+	return nil
+}
+
+// ValidatePSK accepts WPA passphrases of 8 to 63 printable ASCII characters, raw 64-digit hexadecimal keys, and the
+// empty string for open networks.
+func ValidatePSK(psk string) error {
+	if psk == "" {
+		return nil
+	}
+	if len(psk) == hexPSKLength {
+		for _, r := range psk {
+			if !isHexDigit(r) {
+				return errors.Errorf("a %d character PSK must be hexadecimal", hexPSKLength)
+			}
+		}
+		return nil
+	}
+	if len(psk) < minPassphraseLen || len(psk) > maxPassphraseLen {
+		return errors.Errorf("PSK must be %d to %d characters, got %d", minPassphraseLen, maxPassphraseLen, len(psk))
+	}
+	for _, r := range psk {
+		if r < ' ' || r > '~' {
+			return errors.New("PSK must only contain printable ASCII characters")
+		}
+	}
+	return nil
+}
+
+// ValidateRobotPartKeyID accepts robot part key IDs, which are UUIDs.
+func ValidateRobotPartKeyID(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return errors.New("robot part key ID must be a UUID")
+	}
+	return nil
+}
+
+// ValidateRobotPartKey accepts non-empty robot part keys of printable, non-space ASCII characters.
+func ValidateRobotPartKey(key string) error {
+	if len(key) == 0 || len(key) > maxRobotPartKeyLen {
+		return errors.Errorf("robot part key must be 1 to %d characters, got %d", maxRobotPartKeyLen, len(key))
+	}
+	for _, r := range key {
+		if r <= ' ' || r > '~' {
+			return errors.New("robot part key must only contain printable, non-space ASCII characters")
+		}
+	}
+	return nil
+}
+
+// truncateReason shortens reason to at most maxReasonLength bytes, marking it as truncated, without splitting a UTF-8
+// encoded character.
+func truncateReason(reason string) string {
+	if len(reason) <= maxReasonLength {
+		return reason
+	}
+	const ellipsis = "..."
+	cut := maxReasonLength - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(reason[cut]) {
+		cut--
+	}
+	return reason[:cut] + ellipsis
+}
+
+func isHexDigit(r rune) bool {
+	return (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+// WriteRejection is the payload of the write rejection characteristic: the reason the last write to a characteristic
+// was rejected. It is empty once a value is accepted for that characteristic again.
+type WriteRejection struct {
+	Characteristic string `json:"characteristic,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+func (wr *WriteRejection) ToBytes() ([]byte, error) {
+	return json.Marshal(wr)
+}
+
+// rejectionReporter publishes why writes were rejected, so that clients can correct their input. BlueZ write handlers
+// (through tinygo) cannot respond with ATT errors, so this characteristic is the only way rejections reach the client.
+// Reasons are truncated to maxReasonLength.
+type rejectionReporter struct {
+	mu       *sync.Mutex
+	current  WriteRejection
+	encoding Encoding
+	handle   *characteristicHandle
+}
+
+func newRejectionReporter() (*rejectionReporter, error) {
+	rr := &rejectionReporter{mu: &sync.Mutex{}, encoding: EncodingJSON}
+	bs, err := rr.current.ToBytes()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to cast write rejection to bytes")
+	}
+	rr.handle = newCharacteristicHandle(bs)
+	return rr, nil
+}
+
+// reject publishes the reason a write to the characteristic with the given name was rejected.
+func (rr *rejectionReporter) reject(name string, reason error) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.publishLocked(WriteRejection{Characteristic: name, Reason: truncateReason(reason.Error())})
+}
+
+// accept clears the last rejection if it was for the characteristic with the given name.
+func (rr *rejectionReporter) accept(name string) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.current.Characteristic != name {
+		return nil
+	}
+	return rr.publishLocked(WriteRejection{})
+}
+
+// clear clears the last rejection, whichever characteristic it was for.
+func (rr *rejectionReporter) clear() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.publishLocked(WriteRejection{})
+}
+
+// setEncoding re-publishes the last rejection in the given encoding.
+func (rr *rejectionReporter) setEncoding(encoding Encoding) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.encoding = encoding
+	return rr.publishLocked(rr.current)
+}
+
+func (rr *rejectionReporter) publishLocked(rejection WriteRejection) error {
+	bs, err := rr.encoding.encode(&rejection)
+	if err != nil {
+		return errors.WithMessage(err, "failed to cast write rejection to bytes")
+	}
+	if _, err := rr.handle.Write(bs); err != nil {
+		return errors.WithMessage(err, "failed to write write rejection to bluetooth characteristic")
+	}
+	rr.current = rejection
+	return nil
+}
@@ -0,0 +1,128 @@
+package bleperipheral
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidators(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		validate Validator[string]
+		value    string
+		ok       bool
+	}{
+		{"SSID", ValidateSSID, "net", true},
+		{"SSID of 32 bytes", ValidateSSID, strings.Repeat("s", 32), true},
+		{"SSID of 32 multi-byte characters", ValidateSSID, strings.Repeat("é", 16), true},
+		{"empty SSID", ValidateSSID, "", false},
+		{"SSID of 33 bytes", ValidateSSID, strings.Repeat("s", 33), false},
+
+		{"empty PSK", ValidatePSK, "", true},
+		{"passphrase", ValidatePSK, "password1", true},
+		{"passphrase of 8 characters", ValidatePSK, "12345678", true},
+		{"passphrase of 63 characters", ValidatePSK, strings.Repeat("p", 63), true},
+		{"passphrase with spaces", ValidatePSK, "correct horse battery", true},
+		{"hexadecimal PSK", ValidatePSK, strings.Repeat("aF09", 16), true},
+		{"passphrase of 7 characters", ValidatePSK, "1234567", false},
+		{"non-hexadecimal PSK of 64 characters", ValidatePSK, strings.Repeat("g", 64), false},
+		{"passphrase of 65 characters", ValidatePSK, strings.Repeat("p", 65), false},
+		{"non-ASCII passphrase", ValidatePSK, "pässwörd", false},
+		{"passphrase with control character", ValidatePSK, "password\n", false},
+
+		{"robot part key ID", ValidateRobotPartKeyID, "0b4a5e0e-7d6b-4a3b-9a3e-1f2d3c4b5a69", true},
+		{"empty robot part key ID", ValidateRobotPartKeyID, "", false},
+		{"malformed robot part key ID", ValidateRobotPartKeyID, "0b4a5e0e-7d6b-4a3b-9a3e", false},
+
+		{"robot part key", ValidateRobotPartKey, "secretkey", true},
+		{"robot part key of 256 characters", ValidateRobotPartKey, strings.Repeat("k", 256), true},
+		{"empty robot part key", ValidateRobotPartKey, "", false},
+		{"robot part key with space", ValidateRobotPartKey, "secret key", false},
+		{"robot part key of 257 characters", ValidateRobotPartKey, strings.Repeat("k", 257), false},
+		{"non-ASCII robot part key", ValidateRobotPartKey, "schlüssel", false},
+	} {
+		if err := tc.validate(tc.value); (err == nil) != tc.ok {
+			t.Errorf("%s: %q validated with %v, want ok %t", tc.name, tc.value, err, tc.ok)
+		}
+	}
+}
+
+func TestRejectionReporter(t *testing.T) {
+	rr, err := newRejectionReporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := func() WriteRejection {
+		t.Helper()
+		var rejection WriteRejection
+		if err := json.Unmarshal(rr.handle.currentValue(), &rejection); err != nil {
+			t.Fatal(err)
+		}
+		return rejection
+	}
+
+	if err := rr.reject(PskCharacteristic, ValidatePSK("short")); err != nil {
+		t.Fatal(err)
+	}
+	if rejection := published(); rejection.Characteristic != PskCharacteristic || rejection.Reason == "" {
+		t.Fatalf("published %+v, want a rejection for %s", rejection, PskCharacteristic)
+	}
+	if err := rr.accept(SsidCharacteristic); err != nil {
+		t.Fatal(err)
+	}
+	if rejection := published(); rejection.Characteristic != PskCharacteristic {
+		t.Fatalf("accepting another characteristic cleared the rejection, published %+v", rejection)
+	}
+	if err := rr.accept(PskCharacteristic); err != nil {
+		t.Fatal(err)
+	}
+	if rejection := published(); rejection != (WriteRejection{}) {
+		t.Fatalf("published %+v, want the rejection cleared", rejection)
+	}
+
+	if err := rr.reject(SsidCharacteristic, ValidateSSID("")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rr.clear(); err != nil {
+		t.Fatal(err)
+	}
+	if rejection := published(); rejection != (WriteRejection{}) {
+		t.Fatalf("published %+v, want the rejection cleared", rejection)
+	}
+}
+
+func TestTruncateReason(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		reason string
+		want   string
+	}{
+		{"short", "SSID must be 1 to 32 bytes, got 0", "SSID must be 1 to 32 bytes, got 0"},
+		{"at the limit", strings.Repeat("r", maxReasonLength), strings.Repeat("r", maxReasonLength)},
+		{"too long", strings.Repeat("r", maxReasonLength+1), strings.Repeat("r", maxReasonLength-3) + "..."},
+		// "é" is 2 bytes, so cutting at maxReasonLength-3 would split one.
+		{
+			"multibyte",
+			"rr" + strings.Repeat("é", maxReasonLength),
+			"rr" + strings.Repeat("é", (maxReasonLength-5)/2) + "...",
+		},
+	} {
+		if got := truncateReason(tc.reason); got != tc.want {
+			t.Errorf("%s: truncateReason(%q) = %q, want %q", tc.name, tc.reason, got, tc.want)
+		}
+	}
+
+	// The longest reason fits in a single ATT read, even for the rejection of a characteristic with a long name.
+	rejection := WriteRejection{
+		Characteristic: "proof-of-possession response",
+		Reason:         truncateReason(strings.Repeat("r", 2*maxReasonLength)),
+	}
+	bs, err := rejection.ToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bs) > defaultNetworksPageSize {
+		t.Errorf("write rejection is %d bytes, more than fits in a single ATT read (%d)", len(bs), defaultNetworksPageSize)
+	}
+}
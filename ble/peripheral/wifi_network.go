@@ -0,0 +1,78 @@
+package bleperipheral
+
+// WiFiSecurity is the kind of security a WiFi network requires.
+type WiFiSecurity string
+
+const (
+	SecurityOpen       WiFiSecurity = "open"
+	SecurityWEP        WiFiSecurity = "wep"
+	SecurityWPA2       WiFiSecurity = "wpa2" // Including WPA and WPA2/WPA3 transitional networks.
+	SecurityWPA3       WiFiSecurity = "wpa3"
+	SecurityEnterprise WiFiSecurity = "enterprise" // 802.1X, which cannot be joined with a PSK alone.
+)
+
+// WiFiBand is the frequency band a WiFi network operates in.
+type WiFiBand string
+
+const (
+	Band2_4GHz WiFiBand = "2.4GHz"
+	Band5GHz   WiFiBand = "5GHz"
+	Band6GHz   WiFiBand = "6GHz"
+)
+
+// WiFiNetwork describes a WiFi network available to the device. The fields following RequiresPsk are left out of the
+// encoded network when unknown (zero), to keep pages of networks small, and altogether if the network would not fit a
+// page otherwise. For the same reason they have short JSON keys, and the band and channel are left out of JSON, as
+// clients can derive them from the frequency.
+type WiFiNetwork struct {
+	Ssid         string       `json:"ssid"`
+	Strength     float64      `json:"strength"` // In the inclusive range [0.0, 1.0].
+	RequiresPsk  bool         `json:"requires_psk"`
+	Security     WiFiSecurity `json:"sec,omitempty"`
+	FrequencyMHz int          `json:"mhz,omitempty"` // Of the strongest access point.
+	Band         WiFiBand     `json:"-"`
+	Channel      int          `json:"-"`
+	BSSIDCount   int          `json:"aps,omitempty"`   // Number of access points seen broadcasting the SSID.
+	RSSI         int          `json:"rssi,omitempty"`  // Of the strongest access point, in dBm.
+	Saved        bool         `json:"saved,omitempty"` // Whether a connection to the network is already saved.
+}
+
+// essentials returns a copy of the network without the fields following RequiresPsk.
+func (n *WiFiNetwork) essentials() *WiFiNetwork {
+	return &WiFiNetwork{Ssid: n.Ssid, Strength: n.Strength, RequiresPsk: n.RequiresPsk}
+}
+
+// WiFiBandFromFrequency returns the band of the given frequency in MHz, or "" if it is not a WiFi frequency.
+func WiFiBandFromFrequency(frequencyMHz int) WiFiBand {
+	switch {
+	case frequencyMHz >= 2401 && frequencyMHz <= 2495:
+		return Band2_4GHz
+	case frequencyMHz >= 5150 && frequencyMHz <= 5895:
+		return Band5GHz
+	case frequencyMHz >= 5925 && frequencyMHz <= 7125:
+		return Band6GHz
+	default:
+		return ""
+	}
+}
+
+// WiFiChannelFromFrequency returns the channel number of the given center frequency in MHz, or 0 if it is not a WiFi
+// frequency.
+func WiFiChannelFromFrequency(frequencyMHz int) int {
+	switch WiFiBandFromFrequency(frequencyMHz) {
+	case Band2_4GHz:
+		if frequencyMHz == 2484 {
+			return 14
+		}
+		return (frequencyMHz - 2407) / 5
+	case Band5GHz:
+		return (frequencyMHz - 5000) / 5
+	case Band6GHz:
+		if frequencyMHz == 5935 {
+			return 2
+		}
+		return (frequencyMHz - 5950) / 5
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,215 @@
+package diagnostics
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	nm "github.com/Wifx/gonetworkmanager"
+	"github.com/godbus/dbus/v5"
+
+	bp "github.com/maxhorowitz/btprov/ble/peripheral"
+)
+
+const (
+	networkManagerService = "org.freedesktop.NetworkManager"
+	networkManagerPath    = "/org/freedesktop/NetworkManager"
+	dbusAccessDenied      = "org.freedesktop.DBus.Error.AccessDenied"
+	rfkillSysfs           = "/sys/class/rfkill"
+
+	remediationRoot = "run as root, or as a user allowed to use the service by its D-Bus policy (e.g. in the " +
+		"bluetooth and netdev groups)"
+	remediationRFKill = "check that the adapter is not blocked with `rfkill list bluetooth`"
+)
+
+// networkManagerPermissions are the NetworkManager permissions needed to scan for and connect to Wi-Fi networks.
+var networkManagerPermissions = []string{
+	"org.freedesktop.NetworkManager.enable-disable-wifi",
+	"org.freedesktop.NetworkManager.network-control",
+	"org.freedesktop.NetworkManager.settings.modify.system",
+	"org.freedesktop.NetworkManager.wifi.scan",
+}
+
+func checkOS(context.Context, string) Result {
+	if runtime.GOOS != "linux" {
+		return fail("run on a Linux distribution with BlueZ and NetworkManager", "detected %s", runtime.GOOS)
+	}
+	return pass("running on Linux")
+}
+
+// checkServiceRunning checks whether a service owns its well-known name on the system bus.
+func checkServiceRunning(service, unit string) Result {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fail("make sure the D-Bus system bus is running", "failed to connect to system D-Bus: %v", err)
+	}
+	var running bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, service).Store(&running); err != nil {
+		return fail("make sure the D-Bus system bus is running", "failed to look up %s on D-Bus: %v", service, err)
+	}
+	if !running {
+		return fail("start it with `sudo systemctl enable --now "+unit+"`", "%s is not running", unit)
+	}
+	return pass("%s is running", unit)
+}
+
+func checkBluetoothd(context.Context, string) Result {
+	return checkServiceRunning(bp.BluezDBusService, "bluetooth")
+}
+
+func checkNetworkManager(context.Context, string) Result {
+	return checkServiceRunning(networkManagerService, "NetworkManager")
+}
+
+func checkBlueZPermissions(context.Context, string) Result {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fail("make sure the D-Bus system bus is running", "failed to connect to system D-Bus: %v", err)
+	}
+	var objects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+	err = conn.Object(bp.BluezDBusService, "/").
+		Call("org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).Store(&objects)
+	if dbusErr, ok := err.(dbus.Error); ok && dbusErr.Name == dbusAccessDenied {
+		return fail(remediationRoot, "access to BlueZ over D-Bus was denied")
+	}
+	if err != nil {
+		return fail("make sure bluetoothd is running", "failed to call BlueZ over D-Bus: %v", err)
+	}
+	return pass("BlueZ is accessible over D-Bus")
+}
+
+func checkBlueZVersion(_ context.Context, adapterID string) Result {
+	caps, err := bp.ProbeBlueZ(adapterID)
+	if err != nil {
+		return fail("install BlueZ "+bp.MinBlueZVersion.String()+" or later", "failed to detect BlueZ version: %v", err)
+	}
+	if !caps.Version.AtLeast(bp.MinBlueZVersion) {
+		return fail("upgrade BlueZ to "+bp.MinBlueZVersion.String()+" or later",
+			"BlueZ %s is too old (from %s)", caps.Version, caps.VersionSource)
+	}
+	return pass("BlueZ %s (from %s)", caps.Version, caps.VersionSource)
+}
+
+func checkBlueZCapabilities(_ context.Context, adapterID string) Result {
+	caps, err := bp.ProbeBlueZ(adapterID)
+	if err != nil {
+		return fail("make sure the bluetooth adapter is present and bluetoothd is running", "%v", err)
+	}
+	if !caps.LEAdvertisingManager || !caps.GattManager {
+		return fail("use a bluetooth adapter with Bluetooth Low Energy support",
+			"adapter %s lacks LE advertising (%t) or GATT server (%t) support",
+			adapterID, caps.LEAdvertisingManager, caps.GattManager)
+	}
+	if caps.AdvertisingInstances == 0 {
+		return warn("stop other BLE advertisers on this adapter",
+			"adapter %s has no advertising instances available", adapterID)
+	}
+	return pass("adapter %s supports LE advertising (%d instances available) and GATT services",
+		adapterID, caps.AdvertisingInstances)
+}
+
+func checkAdapterPowered(_ context.Context, adapterID string) Result {
+	caps, err := bp.ProbeBlueZ(adapterID)
+	if err != nil {
+		return fail("make sure the bluetooth adapter is present and bluetoothd is running", "%v", err)
+	}
+	if !caps.AdapterPowered {
+		return fail("power it on with `bluetoothctl power on`", "adapter %s (%s) is powered off",
+			adapterID, caps.AdapterAddress)
+	}
+	return pass("adapter %s (%s) is powered on", adapterID, caps.AdapterAddress)
+}
+
+func checkAdapterRFKill(_ context.Context, adapterID string) Result {
+	switches, err := filepath.Glob(filepath.Join(rfkillSysfs, "rfkill*"))
+	if err != nil || len(switches) == 0 {
+		return warn(remediationRFKill, "no rfkill switches found in %s", rfkillSysfs)
+	}
+	for _, sw := range switches {
+		if readSysfs(sw, "type") != "bluetooth" || readSysfs(sw, "name") != adapterID {
+			continue
+		}
+		if readSysfs(sw, "hard") == "1" {
+			return fail("turn off the hardware switch or airplane mode", "adapter %s is hard-blocked by rfkill", adapterID)
+		}
+		if readSysfs(sw, "soft") == "1" {
+			return fail("unblock it with `sudo rfkill unblock bluetooth`", "adapter %s is soft-blocked by rfkill", adapterID)
+		}
+		return pass("adapter %s is not blocked by rfkill", adapterID)
+	}
+	return warn(remediationRFKill, "no rfkill switch found for adapter %s", adapterID)
+}
+
+func readSysfs(dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func checkNetworkManagerPermissions(context.Context, string) Result {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fail("make sure the D-Bus system bus is running", "failed to connect to system D-Bus: %v", err)
+	}
+	var permissions map[string]string
+	err = conn.Object(networkManagerService, networkManagerPath).
+		Call(nm.NetworkManagerGetPermissions, 0).Store(&permissions)
+	if err != nil {
+		return fail("make sure NetworkManager is running", "failed to get NetworkManager permissions: %v", err)
+	}
+	var denied, needAuth []string
+	for _, permission := range networkManagerPermissions {
+		switch permissions[permission] {
+		case "yes":
+		case "auth":
+			needAuth = append(needAuth, permission)
+		default:
+			denied = append(denied, permission)
+		}
+	}
+	if len(denied) > 0 {
+		return fail(remediationRoot, "NetworkManager denied: %s", strings.Join(denied, ", "))
+	}
+	if len(needAuth) > 0 {
+		return warn(remediationRoot, "NetworkManager requires interactive authorization for: %s",
+			strings.Join(needAuth, ", "))
+	}
+	return pass("NetworkManager allows managing Wi-Fi")
+}
+
+func checkWiFiDevice(context.Context, string) Result {
+	networkManager, err := nm.NewNetworkManager()
+	if err != nil {
+		return fail("make sure NetworkManager is running", "failed to connect to NetworkManager: %v", err)
+	}
+	if enabled, err := networkManager.GetPropertyWirelessHardwareEnabled(); err == nil && !enabled {
+		return fail("turn off the hardware switch or airplane mode", "Wi-Fi is hard-blocked by rfkill")
+	}
+	devices, err := networkManager.GetDevices()
+	if err != nil {
+		return fail("make sure NetworkManager is running", "failed to get network devices: %v", err)
+	}
+	var unmanaged []string
+	for _, device := range devices {
+		deviceType, err := device.GetPropertyDeviceType()
+		if err != nil || deviceType != nm.NmDeviceTypeWifi {
+			continue
+		}
+		iface, _ := device.GetPropertyInterface()
+		if managed, err := device.GetPropertyManaged(); err == nil && !managed {
+			unmanaged = append(unmanaged, iface)
+			continue
+		}
+		return pass("Wi-Fi device %s is managed by NetworkManager", iface)
+	}
+	// An unmanaged device can be handed to NetworkManager without restarting anything, so this does not fail the check.
+	if len(unmanaged) > 0 {
+		return warn("let NetworkManager manage it, e.g. with `nmcli device set "+unmanaged[0]+" managed yes`",
+			"Wi-Fi devices are not managed by NetworkManager: %s", strings.Join(unmanaged, ", "))
+	}
+	return fail("attach a Wi-Fi adapter and make sure its driver is loaded", "no Wi-Fi device found")
+}
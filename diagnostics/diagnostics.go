@@ -0,0 +1,109 @@
+// Package diagnostics checks that a device meets the requirements for provisioning over bluetooth, producing a report
+// with remediation steps for anything that does not.
+package diagnostics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusWarn Status = "warn" // Provisioning may work, but is likely to be degraded.
+	StatusFail Status = "fail" // Provisioning will not work.
+)
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name        string `json:"name"`
+	Status      Status `json:"status"`
+	Message     string `json:"message"`
+	Remediation string `json:"remediation,omitempty"` // Not set if Status is StatusPass.
+}
+
+// Report is the outcome of every check, in the order they were run.
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Failed returns whether any check failed.
+func (r *Report) Failed() bool {
+	return r.count(StatusFail) > 0
+}
+
+func (r *Report) count(status Status) int {
+	n := 0
+	for _, result := range r.Results {
+		if result.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// String formats the report for humans, one check per line followed by its remediation, if any.
+func (r *Report) String() string {
+	var sb strings.Builder
+	for _, result := range r.Results {
+		fmt.Fprintf(&sb, "[%s] %s: %s\n", strings.ToUpper(string(result.Status)), result.Name, result.Message)
+		if result.Remediation != "" {
+			fmt.Fprintf(&sb, "       %s\n", result.Remediation)
+		}
+	}
+	fmt.Fprintf(&sb, "%d passed, %d warnings, %d failed\n",
+		r.count(StatusPass), r.count(StatusWarn), r.count(StatusFail))
+	return sb.String()
+}
+
+// check runs a single diagnostic.
+type check struct {
+	name string
+	run  func(ctx context.Context, adapterID string) Result
+}
+
+// checks lists every diagnostic in the order they are run.
+var checks = []check{
+	{"os", checkOS},
+	{"bluetoothd", checkBluetoothd},
+	{"bluez-permissions", checkBlueZPermissions},
+	{"bluez-version", checkBlueZVersion},
+	{"bluez-capabilities", checkBlueZCapabilities},
+	{"adapter-powered", checkAdapterPowered},
+	{"adapter-rfkill", checkAdapterRFKill},
+	{"networkmanager", checkNetworkManager},
+	{"networkmanager-permissions", checkNetworkManagerPermissions},
+	{"wifi-device", checkWiFiDevice},
+}
+
+// Run runs every check against the given bluetooth adapter (e.g. hci0).
+func Run(ctx context.Context, adapterID string) *Report {
+	report := &Report{}
+	for _, c := range checks {
+		if ctx.Err() != nil {
+			report.Results = append(report.Results, Result{
+				Name: c.name, Status: StatusFail, Message: "not run: " + ctx.Err().Error(),
+			})
+			continue
+		}
+		result := c.run(ctx, adapterID)
+		result.Name = c.name
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+func pass(format string, args ...any) Result {
+	return Result{Status: StatusPass, Message: fmt.Sprintf(format, args...)}
+}
+
+func warn(remediation, format string, args ...any) Result {
+	return Result{Status: StatusWarn, Message: fmt.Sprintf(format, args...), Remediation: remediation}
+}
+
+func fail(remediation, format string, args ...any) Result {
+	return Result{Status: StatusFail, Message: fmt.Sprintf(format, args...), Remediation: remediation}
+}
@@ -11,7 +11,8 @@ require (
 	github.com/pkg/errors v0.9.1
 	go.uber.org/multierr v1.11.0
 	go.viam.com/utils v0.1.128
-	tinygo.org/x/bluetooth v0.10.0
+	google.golang.org/protobuf v1.36.4
+	tinygo.org/x/bluetooth v0.11.0
 )
 
 require (
@@ -32,5 +33,4 @@ require (
 	golang.org/x/text v0.21.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250127172529-29210b9bc287 // indirect
 	google.golang.org/grpc v1.70.0 // indirect
-	google.golang.org/protobuf v1.36.4 // indirect
 )
@@ -2,23 +2,84 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
 	"time"
 
 	"github.com/edaniels/golog"
 	bm "github.com/maxhorowitz/btprov/ble/manager"
 	bp "github.com/maxhorowitz/btprov/ble/peripheral"
+	"github.com/maxhorowitz/btprov/diagnostics"
 	wf "github.com/maxhorowitz/btprov/wifi"
+	"go.viam.com/utils"
 )
 
 func main() {
+	diagnose := flag.Bool("diagnose", false, "check the system meets the requirements for provisioning, then exit")
+	popSecretFile := flag.String("pop-secret-file", "",
+		"require clients to prove possession of the secret in this file, which also lets them reboot the device")
+	flag.Parse()
 	ctx := context.Background()
 
+	// Check for problems which would prevent provisioning before starting, reporting them with remediation steps.
+	report := diagnostics.Run(ctx, "hci0")
+	if *diagnose {
+		fmt.Print(report)
+		if report.Failed() {
+			os.Exit(1)
+		}
+		return
+	}
+	dLogger := golog.NewDebugLogger("diagnostics")
+	for _, result := range report.Results {
+		switch result.Status {
+		case diagnostics.StatusPass:
+			dLogger.Debugw(result.Message, "check", result.Name)
+		case diagnostics.StatusWarn:
+			dLogger.Warnw(result.Message, "check", result.Name, "remediation", result.Remediation)
+		case diagnostics.StatusFail:
+			dLogger.Errorw(result.Message, "check", result.Name, "remediation", result.Remediation)
+		}
+	}
+	if report.Failed() {
+		dLogger.Fatal("system does not meet the requirements for provisioning, see above")
+	}
+
 	// Spin up a BLE connection, wait for required credentials, and cleanly shut down when finished.
 	bLogger := golog.NewDebugLogger("BLE manager")
-	bluetoothWiFiProvisioner, err := bm.NewBluetoothWiFiProvisioner(ctx, bLogger, "Max Horowitz Raspberry Pi 5")
+	opts := []bp.Option{bp.WithAdvertisingTimeout(10 * time.Minute), bp.WithRateLimitPolicy(bp.DefaultRateLimitPolicy())}
+	if *popSecretFile != "" {
+		opts = append(opts, bp.WithProofOfPossessionFile(*popSecretFile))
+	}
+	bluetoothWiFiProvisioner, err := bm.NewBluetoothWiFiProvisioner(ctx, bLogger, "Max Horowitz Raspberry Pi 5", opts...)
 	if err != nil {
 		bLogger.Fatalw("failed to initialize bluetooth manager", "err", err)
 	}
+	// Let clients give up on provisioning, whether waiting for credentials or connecting to Wi-Fi, and, only once they
+	// have proven possession of the device secret, reboot the device. Other commands are rejected as unsupported.
+	provisionCtx, cancelProvisioning := context.WithCancel(ctx)
+	defer cancelProvisioning()
+	bluetoothWiFiProvisioner.HandleCommand(bp.CommandCancel, func() error {
+		if provisionCtx.Err() != nil {
+			return errors.New("provisioning has already finished")
+		}
+		cancelProvisioning()
+		return nil
+	})
+	if *popSecretFile != "" {
+		bluetoothWiFiProvisioner.HandleCommand(bp.CommandReboot, func() error {
+			// Reboot in the background, so that the command is acknowledged before the device goes down.
+			utils.ManagedGo(func() {
+				if err := exec.CommandContext(ctx, "systemctl", "reboot").Run(); err != nil {
+					bLogger.Errorw("failed to reboot", "err", err)
+				}
+			}, nil)
+			return nil
+		})
+	}
 	if err := bluetoothWiFiProvisioner.Start(ctx); err != nil {
 		bLogger.Fatalw("failed to accept incoming connections", "err", err)
 	}
@@ -26,20 +87,29 @@ func main() {
 	// Show example call to "Update" which should update the read-only list of available
 	// networks advertised by the bluetooth service.
 	networks := &bp.AvailableWiFiNetworks{
-		Networks: []*struct {
-			Ssid        string  "json:\"ssid\""
-			Strength    float64 "json:\"strength\""
-			RequiresPsk bool    "json:\"requires_psk\""
-		}{
+		Networks: []*bp.WiFiNetwork{
 			{
-				Ssid:        "Viam",
-				Strength:    0.75,
-				RequiresPsk: true,
+				Ssid:         "Viam",
+				Strength:     0.75,
+				RequiresPsk:  true,
+				Security:     bp.SecurityWPA2,
+				FrequencyMHz: 5180,
+				Band:         bp.Band5GHz,
+				Channel:      36,
+				BSSIDCount:   3,
+				RSSI:         -52,
+				Saved:        true,
 			},
 			{
-				Ssid:        "Viam-2G",
-				Strength:    0.3,
-				RequiresPsk: true,
+				Ssid:         "Viam-2G",
+				Strength:     0.3,
+				RequiresPsk:  true,
+				Security:     bp.SecurityWPA2,
+				FrequencyMHz: 2437,
+				Band:         bp.Band2_4GHz,
+				Channel:      6,
+				BSSIDCount:   1,
+				RSSI:         -78,
 			},
 		},
 	}
@@ -51,20 +121,21 @@ func main() {
 
 	// Show second example call to "Update" (read-only values will be distinct from above).
 	networks = &bp.AvailableWiFiNetworks{
-		Networks: []*struct {
-			Ssid        string  "json:\"ssid\""
-			Strength    float64 "json:\"strength\""
-			RequiresPsk bool    "json:\"requires_psk\""
-		}{
+		Networks: []*bp.WiFiNetwork{
 			{
 				Ssid:        "Max-Replaced-The-WiFi",
 				Strength:    0.95,
 				RequiresPsk: false,
+				Security:    bp.SecurityOpen,
 			},
 			{
-				Ssid:        "Viam-5G",
-				Strength:    0.675,
-				RequiresPsk: true,
+				Ssid:         "Viam-5G",
+				Strength:     0.675,
+				RequiresPsk:  true,
+				Security:     bp.SecurityWPA3,
+				FrequencyMHz: 5745,
+				Band:         bp.Band5GHz,
+				Channel:      149,
 			},
 		},
 	}
@@ -73,7 +144,13 @@ func main() {
 	}
 	bLogger.Info("updated WiFi networks (second)")
 
-	credentials, err := bluetoothWiFiProvisioner.WaitForCredentials(ctx)
+	credentials, err := bluetoothWiFiProvisioner.WaitForCredentials(provisionCtx)
+	if errors.Is(err, bp.ErrAdvertisingTimeout) {
+		bLogger.Fatal("no credentials received before advertising timed out")
+	}
+	if provisionCtx.Err() != nil {
+		bLogger.Fatal("provisioning canceled by client")
+	}
 	if err != nil {
 		bLogger.Fatalw("failed to wait for credentials", "err", err)
 	}
@@ -88,7 +165,29 @@ func main() {
 	if err != nil {
 		wLogger.Fatalf("failed to set up Wi-Fi manager: %v", err)
 	}
-	if err := lwf.ConnectToWiFi(ctx, credentials.GetSSID(), credentials.GetPsk()); err != nil {
+	lwf.SetStageHandler(func(stage wf.Stage) {
+		state := bp.StateScanning
+		if stage == wf.StageConnecting {
+			state = bp.StateConnecting
+		}
+		if err := bluetoothWiFiProvisioner.ReportStatus(ctx, &bp.ProvisioningStatus{State: state}); err != nil {
+			bLogger.Errorw("failed to report provisioning status", "err", err)
+		}
+	})
+	if err := lwf.ConnectToWiFi(provisionCtx, credentials.GetSSID(), credentials.GetPsk()); err != nil {
+		reason := err.Error()
+		if provisionCtx.Err() != nil {
+			reason = "canceled by client"
+		}
+		failed := &bp.ProvisioningStatus{State: bp.StateFailed, Reason: reason}
+		if err := bluetoothWiFiProvisioner.ReportStatus(ctx, failed); err != nil {
+			bLogger.Errorw("failed to report provisioning status", "err", err)
+		}
 		wLogger.Fatalf("failed to connect to Wi-Fi: %v", err)
 	}
+	// Provisioning can no longer be canceled.
+	cancelProvisioning()
+	if err := bluetoothWiFiProvisioner.ReportStatus(ctx, &bp.ProvisioningStatus{State: bp.StateConnected}); err != nil {
+		bLogger.Errorw("failed to report provisioning status", "err", err)
+	}
 }
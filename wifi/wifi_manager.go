@@ -16,13 +16,23 @@ import (
 type WiFiManager interface {
 	ConnectToWiFi(ctx context.Context, ssid, psk string) error
 	IsConnectedToWiFi() bool
+	SetStageHandler(func(Stage))
 }
 
+// Stage is a step of ConnectToWiFi, reported to the handler registered with SetStageHandler.
+type Stage string
+
+const (
+	StageScanning   Stage = "scanning"
+	StageConnecting Stage = "connecting"
+)
+
 type linuxWiFiManager struct {
 	mu *sync.Mutex
 
 	logger          golog.Logger
 	currentWiFiSSID string
+	stageHandler    func(Stage)
 
 	networkManager nm.NetworkManager
 	device         nm.DeviceWireless
@@ -132,6 +142,7 @@ func (lwm *linuxWiFiManager) ConnectToWiFi(ctx context.Context, ssid, psk string
 	}
 
 	// Scan for available Wi-Fi networks
+	lwm.reportStage(StageScanning)
 	if err := wifiDevice.RequestScan(); err != nil {
 		return errors.WithMessage(err, "failed to scan for Wi-Fi networks")
 	}
@@ -239,6 +250,7 @@ func (lwm *linuxWiFiManager) ConnectToWiFi(ctx context.Context, ssid, psk string
 	}
 
 	// Attempt to make the Wi-Fi connection.
+	lwm.reportStage(StageConnecting)
 	if _, err := lwm.networkManager.AddAndActivateWirelessConnection(connection, lwm.device, requestedAccessPoint); err != nil {
 		return errors.WithMessagef(err, "failed to connect to Wi-Fi")
 	}
@@ -263,3 +275,17 @@ func (lwm *linuxWiFiManager) IsConnectedToWiFi() bool {
 	defer lwm.mu.Unlock()
 	return lwm.currentWiFiSSID != ""
 }
+
+// SetStageHandler registers a handler which is called as ConnectToWiFi progresses through each stage.
+func (lwm *linuxWiFiManager) SetStageHandler(handler func(Stage)) {
+	lwm.mu.Lock()
+	defer lwm.mu.Unlock()
+	lwm.stageHandler = handler
+}
+
+// reportStage must be called with the lock held.
+func (lwm *linuxWiFiManager) reportStage(stage Stage) {
+	if lwm.stageHandler != nil {
+		lwm.stageHandler(stage)
+	}
+}